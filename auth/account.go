@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/DenisAltruist/distsys/db"
+	"github.com/DenisAltruist/distsys/utils"
+	jwt "github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type deleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+// getClaimEmail returns email of the user the token is issued to, tokens of
+// OAuth clients have no user behind them
+func getClaimEmail(w http.ResponseWriter, claims *jwt.MapClaims) (string, bool) {
+	email, ok := (*claims)["email"].(string)
+	if !ok || len(email) == 0 {
+		utils.SendError(w, http.StatusForbidden, "Token is not issued to a user")
+		return "", false
+	}
+	return email, true
+}
+
+// changePassword sets new password of the user and signs out all other sessions
+func (s *server) changePassword(w http.ResponseWriter, r *http.Request) {
+	claims := s.authorizeRequest(w, r)
+	if claims == nil {
+		return
+	}
+	email, ok := getClaimEmail(w, claims)
+	if !ok {
+		return
+	}
+	var req changePasswordRequest
+	if !utils.ReadJSON(w, r, &req) {
+		return
+	}
+	if sendFieldErrors(w, passwordRules.check("new_password", req.NewPassword, email)) {
+		return
+	}
+	_, err := s.checkCredentials(r.Context(), email, req.CurrentPassword, getClientIP(r))
+	if err != nil {
+		sendCredentialsError(w, err)
+		return
+	}
+	passwordHash, err := calcPassHash(req.NewPassword)
+	if err != nil {
+		utils.SendError(w, http.StatusInternalServerError, "Can't calculate password hash, got an error: %s", err.Error())
+		return
+	}
+	filter := bson.D{bson.E{Key: "email", Value: email}}
+	update := bson.D{
+		bson.E{Key: "$set", Value: bson.D{bson.E{Key: "password_hash", Value: passwordHash}}},
+		bson.E{Key: "$unset", Value: bson.D{bson.E{Key: "password", Value: ""}}},
+	}
+	_, err = s.users.UpdateUser(r.Context(), &filter, &update)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't update password, got an error: %s", err.Error())
+		return
+	}
+	sessionsFilter := bson.D{bson.E{Key: "email", Value: email}}
+	if sessionID, ok := (*claims)["sid"].(string); ok {
+		sessionsFilter = append(sessionsFilter, bson.E{Key: "family_id", Value: bson.D{bson.E{Key: "$ne", Value: sessionID}}})
+	}
+	// the old password is gone, sessions signed in with it must not survive
+	// the client disconnecting
+	err = s.revokeSessions(context.Background(), &sessionsFilter)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Password is changed, but can't revoke sessions, got an error: %s", err.Error())
+		return
+	}
+	utils.SendBodyResponse(w, "Password is changed", http.StatusOK)
+}
+
+// deleteAccount removes the user confirmed by password, all of its tokens,
+// sessions and API keys are revoked before that
+func (s *server) deleteAccount(w http.ResponseWriter, r *http.Request) {
+	claims := s.authorizeRequest(w, r)
+	if claims == nil {
+		return
+	}
+	email, ok := getClaimEmail(w, claims)
+	if !ok {
+		return
+	}
+	// password is read from the body, query strings end up in access logs
+	var req deleteAccountRequest
+	if !utils.ReadJSON(w, r, &req) {
+		return
+	}
+	_, err := s.checkCredentials(r.Context(), email, req.Password, getClientIP(r))
+	if err != nil {
+		sendCredentialsError(w, err)
+		return
+	}
+	filter := bson.D{bson.E{Key: "email", Value: email}}
+	err = s.revokeSessions(r.Context(), &filter)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't revoke sessions, got an error: %s", err.Error())
+		return
+	}
+	revoke := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "revoked", Value: true}}}}
+	_, err = s.apiKeys.UpdateAPIKeys(r.Context(), &filter, &revoke)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't revoke API keys, got an error: %s", err.Error())
+		return
+	}
+	_, err = s.users.RemoveUser(r.Context(), &filter)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't delete account, got an error: %s", err.Error())
+		return
+	}
+	utils.SendBodyResponse(w, "Account is deleted", http.StatusOK)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/DenisAltruist/distsys/db"
+	"github.com/DenisAltruist/distsys/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var knownRoles = []string{db.RoleAdmin, db.RoleEditor, db.RoleViewer}
+
+// userView is what admins see of the user, no password hashes and secrets
+type userView struct {
+	Email                 string   `json:"email"`
+	Roles                 []string `json:"roles"`
+	Status                string   `json:"status"`
+	TOTPEnabled           bool     `json:"totp_enabled"`
+	PasswordResetRequired bool     `json:"password_reset_required"`
+}
+
+type usersListView struct {
+	Count int64       `json:"count"`
+	List  []*userView `json:"list"`
+}
+
+type assignRolesRequest struct {
+	Email string   `json:"email"`
+	Roles []string `json:"roles"`
+}
+
+func newUserView(user *db.ShopUser) *userView {
+	status := user.Status
+	if status == "" {
+		status = db.UserStatusActive
+	}
+	return &userView{
+		Email:                 user.Email,
+		Roles:                 user.Roles,
+		Status:                status,
+		TOTPEnabled:           user.TOTPEnabled,
+		PasswordResetRequired: user.PasswordResetRequired,
+	}
+}
+
+// findUserByEmail finds user of 'email' argument, responds itself if there is no such user
+func (s *server) findUserByEmail(ctx context.Context, w http.ResponseWriter, email string) *db.ShopUser {
+	if len(email) == 0 {
+		utils.SendError(w, http.StatusBadRequest, "'email' argument is not specified")
+		return nil
+	}
+	user, err := s.users.FindUser(ctx, email)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Got an error on find user: %s", err.Error())
+		return nil
+	}
+	if user == nil {
+		utils.SendError(w, http.StatusNotFound, "There is no user with email %s", email)
+		return nil
+	}
+	return user
+}
+
+// listUsers searches users by part of email, status and role
+func (s *server) listUsers(w http.ResponseWriter, r *http.Request) {
+	if s.authorizeRequest(w, r, db.RoleAdmin) == nil {
+		return
+	}
+	offsetStr := r.FormValue("offset") // pagination
+	limitStr := r.FormValue("limit")   // pagination
+	offset, err := strconv.ParseInt(offsetStr, 10, 64)
+	if err != nil {
+		utils.SendError(w, http.StatusBadRequest, "Specified offset is not correct: %s", err.Error())
+		return
+	}
+	limit, err := strconv.ParseInt(limitStr, 10, 64)
+	if err != nil {
+		utils.SendError(w, http.StatusBadRequest, "Specified limit is not correct: %s", err.Error())
+		return
+	}
+	filter := bson.D{}
+	if query := r.FormValue("q"); len(query) != 0 {
+		filter = append(filter, bson.E{Key: "email", Value: primitive.Regex{Pattern: regexp.QuoteMeta(query), Options: "i"}})
+	}
+	switch status := r.FormValue("status"); status {
+	case "":
+	case db.UserStatusActive: // users created before email verification have no status
+		filter = append(filter, bson.E{Key: "status", Value: bson.D{bson.E{Key: "$in", Value: bson.A{db.UserStatusActive, nil}}}})
+	default:
+		filter = append(filter, bson.E{Key: "status", Value: status})
+	}
+	if role := r.FormValue("role"); len(role) != 0 {
+		filter = append(filter, bson.E{Key: "roles", Value: role})
+	}
+	users, err := s.users.FindUsers(r.Context(), &filter, offset, limit)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't find users, got an error: %s", err.Error())
+		return
+	}
+	result := usersListView{Count: users.Count, List: []*userView{}}
+	for _, user := range users.List {
+		result.List = append(result.List, newUserView(user))
+	}
+	utils.SendJSON(w, &result, http.StatusOK)
+}
+
+func (s *server) showUser(w http.ResponseWriter, r *http.Request) {
+	if s.authorizeRequest(w, r, db.RoleAdmin) == nil {
+		return
+	}
+	email := canonicalEmail(r.FormValue("email"))
+	setAuditTarget(r, email)
+	user := s.findUserByEmail(r.Context(), w, email)
+	if user == nil {
+		return
+	}
+	utils.SendJSON(w, newUserView(user), http.StatusOK)
+}
+
+// setUserStatus disables or enables back the user, disabled user is signed out everywhere
+func (s *server) setUserStatus(w http.ResponseWriter, r *http.Request) {
+	claims := s.authorizeRequest(w, r, db.RoleAdmin)
+	if claims == nil {
+		return
+	}
+	status := r.FormValue("status")
+	if status != db.UserStatusActive && status != db.UserStatusDisabled {
+		utils.SendError(w, http.StatusBadRequest, "Status must be either %s or %s", db.UserStatusActive, db.UserStatusDisabled)
+		return
+	}
+	email := canonicalEmail(r.FormValue("email"))
+	setAuditTarget(r, email)
+	if email == (*claims)["email"] && status == db.UserStatusDisabled {
+		utils.SendError(w, http.StatusBadRequest, "Can't disable yourself")
+		return
+	}
+	user := s.findUserByEmail(r.Context(), w, email)
+	if user == nil {
+		return
+	}
+	// pending users become active only by verifying their email
+	if status == db.UserStatusActive && user.Status != db.UserStatusDisabled {
+		utils.SendError(w, http.StatusConflict, "Only disabled user can be enabled, status is %s", user.Status)
+		return
+	}
+	filter := bson.D{bson.E{Key: "email", Value: email}}
+	updateFilter := filter
+	if status == db.UserStatusActive {
+		updateFilter = append(updateFilter, bson.E{Key: "status", Value: db.UserStatusDisabled})
+	}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "status", Value: status}}}}
+	matched, err := s.users.UpdateUser(r.Context(), &updateFilter, &update)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't update status, got an error: %s", err.Error())
+		return
+	}
+	if matched == 0 {
+		utils.SendError(w, http.StatusConflict, "Status has been changed concurrently, try again")
+		return
+	}
+	if status == db.UserStatusDisabled {
+		// the user is disabled already, the admin going away must not leave it signed in
+		err = s.revokeSessions(context.Background(), &filter)
+		if err != nil {
+			utils.SendError(w, db.ErrorStatus(err), "Disabled, but can't revoke sessions, got an error: %s", err.Error())
+			return
+		}
+	}
+	user = s.findUserByEmail(r.Context(), w, email)
+	if user == nil {
+		return
+	}
+	utils.SendJSON(w, newUserView(user), http.StatusOK)
+}
+
+// assignRoles replaces roles of the user, the user has to sign in again so that
+// tokens with previous roles are not used anymore
+func (s *server) assignRoles(w http.ResponseWriter, r *http.Request) {
+	claims := s.authorizeRequest(w, r, db.RoleAdmin)
+	if claims == nil {
+		return
+	}
+	var req assignRolesRequest
+	if !utils.ReadJSON(w, r, &req) {
+		return
+	}
+	req.Email = canonicalEmail(req.Email)
+	setAuditTarget(r, req.Email)
+	for _, role := range req.Roles {
+		if !containsString(knownRoles, role) {
+			utils.SendError(w, http.StatusBadRequest, "Role %s is not known", role)
+			return
+		}
+	}
+	if req.Email == (*claims)["email"] && !containsString(req.Roles, db.RoleAdmin) {
+		utils.SendError(w, http.StatusBadRequest, "Can't remove admin role from yourself")
+		return
+	}
+	if s.findUserByEmail(r.Context(), w, req.Email) == nil {
+		return
+	}
+	if req.Roles == nil {
+		req.Roles = []string{}
+	}
+	filter := bson.D{bson.E{Key: "email", Value: req.Email}}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "roles", Value: req.Roles}}}}
+	_, err := s.users.UpdateUser(r.Context(), &filter, &update)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't assign roles, got an error: %s", err.Error())
+		return
+	}
+	// tokens carry previous roles until they are revoked, even if the admin disconnects
+	err = s.revokeSessions(context.Background(), &filter)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Roles are assigned, but can't revoke sessions, got an error: %s", err.Error())
+		return
+	}
+	user := s.findUserByEmail(r.Context(), w, req.Email)
+	if user == nil {
+		return
+	}
+	utils.SendJSON(w, newUserView(user), http.StatusOK)
+}
+
+// forcePasswordReset signs the user out and mails reset token, the user can't
+// sign in until password is reset
+func (s *server) forcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	if s.authorizeRequest(w, r, db.RoleAdmin) == nil {
+		return
+	}
+	email := canonicalEmail(r.FormValue("email"))
+	setAuditTarget(r, email)
+	if s.findUserByEmail(r.Context(), w, email) == nil {
+		return
+	}
+	filter := bson.D{bson.E{Key: "email", Value: email}}
+	_, err := s.sendPasswordResetEmail(r.Context(), &filter, true)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't send reset email, got an error: %s", err.Error())
+		return
+	}
+	// reset token is mailed already, so sessions are revoked regardless of the admin
+	err = s.revokeSessions(context.Background(), &filter)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Reset email is sent, but can't revoke sessions, got an error: %s", err.Error())
+		return
+	}
+	utils.SendBodyResponse(w, "Reset email is sent", http.StatusOK)
+}
+
+func (s *server) revokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	if s.authorizeRequest(w, r, db.RoleAdmin) == nil {
+		return
+	}
+	email := canonicalEmail(r.FormValue("email"))
+	setAuditTarget(r, email)
+	if s.findUserByEmail(r.Context(), w, email) == nil {
+		return
+	}
+	filter := bson.D{bson.E{Key: "email", Value: email}}
+	// revocation is the whole request, the admin sees it fail and repeats it
+	err := s.revokeSessions(r.Context(), &filter)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't revoke sessions, got an error: %s", err.Error())
+		return
+	}
+	utils.SendBodyResponse(w, "Sessions are revoked", http.StatusOK)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/DenisAltruist/distsys/db"
+)
+
+func TestSetUserStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		current    string
+		status     string
+		wantStatus int
+	}{
+		{name: "enable disabled", current: db.UserStatusDisabled, status: db.UserStatusActive, wantStatus: http.StatusOK},
+		{name: "enable pending", current: db.UserStatusPending, status: db.UserStatusActive, wantStatus: http.StatusConflict},
+		{name: "enable active", current: db.UserStatusActive, status: db.UserStatusActive, wantStatus: http.StatusConflict},
+		{name: "disable active", current: db.UserStatusActive, status: db.UserStatusDisabled, wantStatus: http.StatusOK},
+		{name: "disable pending", current: db.UserStatusPending, status: db.UserStatusDisabled, wantStatus: http.StatusOK},
+		{name: "unknown status", current: db.UserStatusDisabled, status: db.UserStatusPending, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			admin := addTestUser(t, s, "admin@example.com", db.RoleAdmin)
+			user := &db.ShopUser{Email: "alice@example.com", Roles: []string{db.RoleViewer}, Status: tt.current}
+			if err := s.users.AddNewUser(context.Background(), user); err != nil {
+				t.Fatalf("Can't add user: %s", err.Error())
+			}
+			tokens, err := s.issueTokens(admin, "", nil, newTestRequest())
+			if err != nil {
+				t.Fatalf("Can't issue tokens: %s", err.Error())
+			}
+			query := url.Values{"email": {user.Email}, "status": {tt.status}}
+			r := httptest.NewRequest(http.MethodPut, "/admin/user/status?"+query.Encode(), nil)
+			r.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+			w := httptest.NewRecorder()
+			s.setUserStatus(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			wantUserStatus := tt.current
+			if tt.wantStatus == http.StatusOK {
+				wantUserStatus = tt.status
+			}
+			found, err := s.users.FindUser(context.Background(), user.Email)
+			if err != nil || found.Status != wantUserStatus {
+				t.Errorf("User status = %v with error %v, want %s", found, err, wantUserStatus)
+			}
+		})
+	}
+}
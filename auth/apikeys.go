@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/DenisAltruist/distsys/db"
+	"github.com/DenisAltruist/distsys/utils"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// API keys look like dsk_<key id>_<secret>
+const apiKeyPrefix = "dsk"
+
+// lastUsedAt of API key is updated at most this often, keys are checked on every request
+const apiKeyLastUsedInterval = time.Minute
+
+type apiKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type createdAPIKey struct {
+	*db.APIKey
+	Key string `json:"key"`
+}
+
+type apiKeyIdentity struct {
+	Subject string
+	Roles   []string
+	KeyID   string
+}
+
+func parseAPIKey(key string) (string, string, bool) {
+	parts := strings.Split(key, "_")
+	if len(parts) != 3 || parts[0] != apiKeyPrefix {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+func containsString(list []string, value string) bool {
+	for _, cur := range list {
+		if cur == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *server) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	claims := s.authorizeRequest(w, r)
+	if claims == nil {
+		return
+	}
+	var req apiKeyRequest
+	if !utils.ReadJSON(w, r, &req) {
+		return
+	}
+	email, ok := getClaimEmail(w, claims)
+	if !ok {
+		return
+	}
+	user, err := s.users.FindUser(r.Context(), email)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Got an error on find user: %s", err.Error())
+		return
+	}
+	if user == nil {
+		utils.SendError(w, http.StatusUnauthorized, "User doesn't exist anymore")
+		return
+	}
+	// the key can't exceed the token it's created with, e.g. OAuth token of narrowed scope
+	tokenRoles := getClaimRoles(claims)
+	if len(req.Scopes) == 0 {
+		req.Scopes = tokenRoles
+	}
+	for _, scope := range req.Scopes {
+		if !containsString(tokenRoles, scope) {
+			utils.SendError(w, http.StatusForbidden, "Can't grant scope %s which the token doesn't have", scope)
+			return
+		}
+	}
+	keyID, err := randomHex(8)
+	if err != nil {
+		utils.SendError(w, http.StatusInternalServerError, "Can't generate key, got an error: %s", err.Error())
+		return
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		utils.SendError(w, http.StatusInternalServerError, "Can't generate key, got an error: %s", err.Error())
+		return
+	}
+	apiKey := db.APIKey{
+		ID:        keyID,
+		Email:     email,
+		Name:      req.Name,
+		Scopes:    req.Scopes,
+		KeyHash:   hashSecret(secret),
+		CreatedAt: time.Now(),
+	}
+	err = s.apiKeys.AddAPIKey(r.Context(), &apiKey)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't store key, got an error: %s", err.Error())
+		return
+	}
+	// The key itself is shown only once
+	utils.SendJSON(w, &createdAPIKey{
+		APIKey: &apiKey,
+		Key:    fmt.Sprintf("%s_%s_%s", apiKeyPrefix, keyID, secret),
+	}, http.StatusCreated)
+}
+
+func (s *server) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	claims := s.authorizeRequest(w, r)
+	if claims == nil {
+		return
+	}
+	filter := bson.D{
+		bson.E{Key: "email", Value: (*claims)["email"]},
+		bson.E{Key: "revoked", Value: false},
+	}
+	keys, err := s.apiKeys.FindAPIKeys(r.Context(), &filter)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't find keys, got an error: %s", err.Error())
+		return
+	}
+	utils.SendJSON(w, keys, http.StatusOK)
+}
+
+func (s *server) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	claims := s.authorizeRequest(w, r)
+	if claims == nil {
+		return
+	}
+	filterKey := "id"
+	filterVal := r.FormValue(filterKey)
+	if len(filterVal) == 0 {
+		utils.SendError(w, http.StatusBadRequest, "'%s' argument is not specified", filterKey)
+		return
+	}
+	filter := bson.D{
+		bson.E{Key: "key_id", Value: filterVal},
+		bson.E{Key: "email", Value: (*claims)["email"]},
+	}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "revoked", Value: true}}}}
+	matched, err := s.apiKeys.UpdateAPIKeys(r.Context(), &filter, &update)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't revoke key, got an error: %s", err.Error())
+		return
+	}
+	if matched == 0 {
+		utils.SendError(w, http.StatusBadRequest, "There is no key with id %s to revoke", filterVal)
+		return
+	}
+	utils.SendBodyResponse(w, "Success", http.StatusOK)
+}
+
+// checkAPIKey returns identity of the key owner or nil if the key is not valid.
+// Scopes of the key are limited by current roles of its owner.
+func (s *server) checkAPIKey(ctx context.Context, key string) (*apiKeyIdentity, error) {
+	keyID, secret, ok := parseAPIKey(key)
+	if !ok {
+		return nil, nil
+	}
+	filter := bson.D{
+		bson.E{Key: "key_id", Value: keyID},
+		bson.E{Key: "revoked", Value: false},
+	}
+	keys, err := s.apiKeys.FindAPIKeys(ctx, &filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 || subtle.ConstantTimeCompare([]byte(keys[0].KeyHash), []byte(hashSecret(secret))) != 1 {
+		return nil, nil
+	}
+	apiKey := keys[0]
+	user, err := s.users.FindUser(ctx, apiKey.Email)
+	if err != nil || user == nil || user.Status == db.UserStatusDisabled {
+		return nil, err
+	}
+	roles := []string{}
+	for _, scope := range apiKey.Scopes {
+		if containsString(user.Roles, scope) {
+			roles = append(roles, scope)
+		}
+	}
+	if apiKey.LastUsedAt == nil || time.Since(*apiKey.LastUsedAt) >= apiKeyLastUsedInterval {
+		now := time.Now()
+		// concurrent requests with the same key update it only once
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{bson.E{Key: "last_used_at", Value: bson.D{bson.E{Key: "$exists", Value: false}}}},
+			bson.D{bson.E{Key: "last_used_at", Value: bson.D{bson.E{Key: "$lte", Value: now.Add(-apiKeyLastUsedInterval)}}}},
+		}})
+		update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "last_used_at", Value: now}}}}
+		_, err = s.apiKeys.UpdateAPIKeys(ctx, &filter, &update)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &apiKeyIdentity{Subject: apiKey.Email, Roles: roles, KeyID: apiKey.ID}, nil
+}
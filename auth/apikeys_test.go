@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DenisAltruist/distsys/db"
+)
+
+func TestCreateAPIKeyScopes(t *testing.T) {
+	tests := []struct {
+		name       string
+		grant      *oauthGrant
+		scopes     []string
+		wantStatus int
+		wantScopes []string
+	}{
+		{name: "all roles of user token", wantStatus: http.StatusCreated, wantScopes: []string{db.RoleAdmin, db.RoleViewer}},
+		{name: "role of user token", scopes: []string{db.RoleAdmin}, wantStatus: http.StatusCreated, wantScopes: []string{db.RoleAdmin}},
+		{name: "role the user doesn't have", scopes: []string{db.RoleEditor}, wantStatus: http.StatusForbidden},
+		{
+			name: "all roles of narrowed token", grant: &oauthGrant{clientID: "reporting", scope: []string{db.RoleViewer}},
+			wantStatus: http.StatusCreated, wantScopes: []string{db.RoleViewer},
+		},
+		{
+			name: "role beyond narrowed token", grant: &oauthGrant{clientID: "reporting", scope: []string{db.RoleViewer}},
+			scopes: []string{db.RoleAdmin}, wantStatus: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			user := addTestUser(t, s, "alice@example.com", db.RoleAdmin, db.RoleViewer)
+			tokens, err := s.issueTokens(user, "", tt.grant, newTestRequest())
+			if err != nil {
+				t.Fatalf("Can't issue tokens: %s", err.Error())
+			}
+			body, _ := json.Marshal(&apiKeyRequest{Name: "ci", Scopes: tt.scopes})
+			r := httptest.NewRequest(http.MethodPost, "/apikeys", bytes.NewReader(body))
+			r.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+			w := httptest.NewRecorder()
+			s.createAPIKey(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantStatus != http.StatusCreated {
+				return
+			}
+			var created createdAPIKey
+			if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+				t.Fatalf("Can't decode created key: %s", err.Error())
+			}
+			if !containsAll(created.Scopes, tt.wantScopes) || len(created.Scopes) != len(tt.wantScopes) {
+				t.Errorf("Scopes = %v, want %v", created.Scopes, tt.wantScopes)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DenisAltruist/distsys/db"
+	"github.com/DenisAltruist/distsys/utils"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// Only this much of error responses is kept to find out the reason
+	maxAuditReasonBodySize = 4096
+	// Events which don't fit while the database is slow are dropped
+	auditBufferSize = 1024
+)
+
+type auditContextKey struct{}
+
+// auditRecorder captures status and error response of the handler
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *auditRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *auditRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	// successful responses may contain tokens and secrets, so they are never kept
+	if rec.status >= 400 && rec.body.Len() < maxAuditReasonBodySize {
+		rec.body.Write(b)
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// reason extracts message of either native or OAuth2 error response
+func (rec *auditRecorder) reason() string {
+	if rec.status < 400 {
+		return ""
+	}
+	var resp struct {
+		Text        string
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if json.Unmarshal(rec.body.Bytes(), &resp) != nil {
+		return ""
+	}
+	if len(resp.Text) != 0 {
+		return resp.Text
+	}
+	if len(resp.Description) != 0 {
+		return fmt.Sprintf("%s: %s", resp.Error, resp.Description)
+	}
+	return resp.Error
+}
+
+// auditWriter writes events in background, so that responses don't wait for
+// the audit log
+type auditWriter struct {
+	repository db.AuditRepository
+	events     chan *db.AuditEvent
+	done       chan struct{}
+	// handlers outliving shutdown timeout may still add events after close
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newAuditWriter(repository db.AuditRepository) *auditWriter {
+	writer := &auditWriter{
+		repository: repository,
+		events:     make(chan *db.AuditEvent, auditBufferSize),
+		done:       make(chan struct{}),
+	}
+	go writer.run()
+	return writer
+}
+
+func (writer *auditWriter) run() {
+	defer close(writer.done)
+	for event := range writer.events {
+		// the event is written even if the client has already gone
+		err := writer.repository.AddAuditEvent(context.Background(), event)
+		if err != nil {
+			log.Printf("Can't write audit event %s of %s: %s\n", event.Type, event.Email, err.Error())
+		}
+	}
+}
+
+func (writer *auditWriter) add(event *db.AuditEvent) {
+	writer.mu.RLock()
+	defer writer.mu.RUnlock()
+	if writer.closed {
+		log.Printf("Audit log is closed, dropped event %s of %s\n", event.Type, event.Email)
+		return
+	}
+	select {
+	case writer.events <- event:
+	default:
+		log.Printf("Audit buffer is full, dropped event %s of %s\n", event.Type, event.Email)
+	}
+}
+
+// close writes buffered events, it's called once requests are not served anymore
+func (writer *auditWriter) close() {
+	writer.mu.Lock()
+	writer.closed = true
+	close(writer.events)
+	writer.mu.Unlock()
+	<-writer.done
+}
+
+func getAuditOutcome(status int) string {
+	switch {
+	case status >= 500:
+		return db.AuditOutcomeError
+	case status >= 400:
+		return db.AuditOutcomeFailure
+	default:
+		return db.AuditOutcomeSuccess
+	}
+}
+
+func getAuditEvent(r *http.Request) *db.AuditEvent {
+	event, _ := r.Context().Value(auditContextKey{}).(*db.AuditEvent)
+	return event
+}
+
+// setAuditEmail records who made the request
+func setAuditEmail(r *http.Request, email string) {
+	if event := getAuditEvent(r); event != nil && len(email) != 0 {
+		event.Email = email
+	}
+}
+
+// setAuditTarget records the user the request is about
+func setAuditTarget(r *http.Request, email string) {
+	if event := getAuditEvent(r); event != nil {
+		event.Target = email
+	}
+}
+
+// auditMiddleware appends event of the route name for every request to named
+// routes, handlers fill in emails with setAuditEmail and setAuditTarget
+func (s *server) auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil || route.GetName() == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		event := &db.AuditEvent{
+			Type:      route.GetName(),
+			IP:        getClientIP(r),
+			UserAgent: r.UserAgent(),
+			Time:      time.Now(),
+		}
+		rec := &auditRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, event)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		event.Status = rec.status
+		event.Outcome = getAuditOutcome(rec.status)
+		event.Reason = rec.reason()
+		s.audit.add(event)
+	})
+}
+
+// auditRetention parses AUDIT_RETENTION_DAYS, zero keeps events forever
+func auditRetention() (time.Duration, error) {
+	retentionDays, err := strconv.Atoi(os.Getenv("AUDIT_RETENTION_DAYS"))
+	if err != nil {
+		return 0, fmt.Errorf("Can't parse AUDIT_RETENTION_DAYS: %s", err.Error())
+	}
+	return time.Duration(retentionDays) * 24 * time.Hour, nil
+}
+
+func parseAuditTime(w http.ResponseWriter, name string, value string) (time.Time, bool) {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		utils.SendError(w, http.StatusBadRequest, "Specified %s is not RFC 3339 time: %s", name, err.Error())
+		return parsed, false
+	}
+	return parsed, true
+}
+
+// listAuditEvents lets admins search events by user, type, outcome and time range
+func (s *server) listAuditEvents(w http.ResponseWriter, r *http.Request) {
+	if s.authorizeRequest(w, r, db.RoleAdmin) == nil {
+		return
+	}
+	offsetStr := r.FormValue("offset") // pagination
+	limitStr := r.FormValue("limit")   // pagination
+	offset, err := strconv.ParseInt(offsetStr, 10, 64)
+	if err != nil {
+		utils.SendError(w, http.StatusBadRequest, "Specified offset is not correct: %s", err.Error())
+		return
+	}
+	limit, err := strconv.ParseInt(limitStr, 10, 64)
+	if err != nil {
+		utils.SendError(w, http.StatusBadRequest, "Specified limit is not correct: %s", err.Error())
+		return
+	}
+	filter := bson.D{}
+	if email := canonicalEmail(r.FormValue("email")); len(email) != 0 {
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{bson.E{Key: "email", Value: email}},
+			bson.D{bson.E{Key: "target", Value: email}},
+		}})
+	}
+	for _, key := range []string{"type", "outcome", "ip"} {
+		if value := r.FormValue(key); len(value) != 0 {
+			filter = append(filter, bson.E{Key: key, Value: value})
+		}
+	}
+	timeRange := bson.D{}
+	if from := r.FormValue("from"); len(from) != 0 {
+		fromTime, ok := parseAuditTime(w, "from", from)
+		if !ok {
+			return
+		}
+		timeRange = append(timeRange, bson.E{Key: "$gte", Value: fromTime})
+	}
+	if to := r.FormValue("to"); len(to) != 0 {
+		toTime, ok := parseAuditTime(w, "to", to)
+		if !ok {
+			return
+		}
+		timeRange = append(timeRange, bson.E{Key: "$lt", Value: toTime})
+	}
+	if len(timeRange) != 0 {
+		filter = append(filter, bson.E{Key: "time", Value: timeRange})
+	}
+	events, err := s.auditEvents.FindAuditEvents(r.Context(), &filter, offset, limit)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't find audit events, got an error: %s", err.Error())
+		return
+	}
+	utils.SendJSON(w, events, http.StatusOK)
+}
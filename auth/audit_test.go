@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAuditDoesNotKeepMalformedBody(t *testing.T) {
+	s := newTestServer(t)
+	s.audit = newAuditWriter(s.auditEvents)
+	router := mux.NewRouter()
+	router.HandleFunc("/signup", s.signUp).Methods("POST").Name("signup")
+	router.Use(s.auditMiddleware)
+
+	const password = "correct horse battery staple"
+	body := `{"email": "alice@example.com", "password": "` + password + `",}`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/signup", strings.NewReader(body)))
+	s.audit.close()
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), password) {
+		t.Errorf("Response %s contains the password", w.Body.String())
+	}
+	events, err := s.auditEvents.FindAuditEvents(context.Background(), nil, 0, 10)
+	if err != nil || len(events.List) != 1 {
+		t.Fatalf("Got %v with error %v, want one event", events, err)
+	}
+	if reason := events.List[0].Reason; len(reason) == 0 || strings.Contains(reason, password) {
+		t.Errorf("Reason = %q, want error without the password", reason)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/DenisAltruist/distsys/db"
+	"github.com/DenisAltruist/distsys/utils"
+	jwt "github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// isTokenRevoked treats tokens without jti as revoked since they can't be looked up
+func (s *server) isTokenRevoked(ctx context.Context, claims *jwt.MapClaims) (bool, error) {
+	tokenID, ok := (*claims)["jti"].(string)
+	if !ok {
+		return true, nil
+	}
+	filter := bson.D{bson.E{Key: "jti", Value: tokenID}}
+	return s.revocations.IsTokenRevoked(ctx, &filter)
+}
+
+// validateAccessToken checks signature, expiration and revocation of access token
+func (s *server) validateAccessToken(ctx context.Context, w http.ResponseWriter, token string) *jwt.MapClaims {
+	claims := validateEncodedToken(w, token, "access")
+	if claims == nil {
+		return nil
+	}
+	isRevoked, err := s.isTokenRevoked(ctx, claims)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't check token revocation, got an error: %s", err.Error())
+		return nil
+	}
+	if isRevoked {
+		utils.SendError(w, http.StatusUnauthorized, "Token is revoked")
+		return nil
+	}
+	return claims
+}
+
+func getClaimRoles(claims *jwt.MapClaims) []string {
+	rawRoles, _ := (*claims)["roles"].([]interface{})
+	roles := make([]string, 0, len(rawRoles))
+	for _, rawRole := range rawRoles {
+		if role, ok := rawRole.(string); ok {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// authorizeRequest validates Bearer access token of the request. If roles are
+// given, token must have at least one of them.
+func (s *server) authorizeRequest(w http.ResponseWriter, r *http.Request, roles ...string) *jwt.MapClaims {
+	splitAuth := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(splitAuth) != 2 || splitAuth[0] != "Bearer" {
+		utils.SendError(w, http.StatusUnauthorized, "Can't retrieve Bearer from Authorization")
+		return nil
+	}
+	claims := s.validateAccessToken(r.Context(), w, splitAuth[1])
+	if claims == nil {
+		return nil
+	}
+	if email, ok := (*claims)["email"].(string); ok {
+		setAuditEmail(r, email)
+	} else {
+		sub, _ := (*claims)["sub"].(string)
+		setAuditEmail(r, sub)
+	}
+	if len(roles) == 0 {
+		return claims
+	}
+	for _, userRole := range getClaimRoles(claims) {
+		for _, role := range roles {
+			if userRole == role {
+				return claims
+			}
+		}
+	}
+	utils.SendError(w, http.StatusForbidden, "Not enough permissions")
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/DenisAltruist/distsys/db"
+	"github.com/DenisAltruist/distsys/utils"
+	jwt "github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Values of token_type in introspection response, they match schemes of
+// Authorization header accepted by resource servers
+const (
+	introspectionBearer  = "Bearer"
+	introspectionRefresh = "Refresh"
+	introspectionAPIKey  = "ApiKey"
+)
+
+// introspectionResponse is response of RFC 7662, all fields except active are
+// omitted for inactive tokens
+type introspectionResponse struct {
+	Active    bool     `json:"active"`
+	Subject   string   `json:"sub,omitempty"`
+	ClientID  string   `json:"client_id,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	TokenID   string   `json:"jti,omitempty"`
+}
+
+func newIntrospectionResponse(claims *jwt.MapClaims, tokenType string) *introspectionResponse {
+	subject, ok := (*claims)["sub"].(string)
+	if !ok {
+		subject, _ = (*claims)["email"].(string)
+	}
+	clientID, _ := (*claims)["client_id"].(string)
+	tokenID, _ := (*claims)["jti"].(string)
+	exp, _ := (*claims)["exp"].(float64)
+	iat, _ := (*claims)["iat"].(float64)
+	roles := getClaimRoles(claims)
+	return &introspectionResponse{
+		Active:    true,
+		Subject:   subject,
+		ClientID:  clientID,
+		Scope:     strings.Join(roles, " "),
+		Roles:     roles,
+		TokenType: tokenType,
+		ExpiresAt: int64(exp),
+		IssuedAt:  int64(iat),
+		TokenID:   tokenID,
+	}
+}
+
+func (s *server) introspectToken(ctx context.Context, token string) (*introspectionResponse, error) {
+	inactive := &introspectionResponse{Active: false}
+	keyIdentity, err := s.checkAPIKey(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if keyIdentity != nil {
+		return &introspectionResponse{
+			Active:    true,
+			Subject:   keyIdentity.Subject,
+			Scope:     strings.Join(keyIdentity.Roles, " "),
+			Roles:     keyIdentity.Roles,
+			TokenType: introspectionAPIKey,
+			TokenID:   keyIdentity.KeyID,
+		}, nil
+	}
+	if claims, err := validateToken(token, "access", 0); err == nil {
+		isRevoked, err := s.isTokenRevoked(ctx, claims)
+		if err != nil {
+			return nil, err
+		}
+		if isRevoked {
+			return inactive, nil
+		}
+		return newIntrospectionResponse(claims, introspectionBearer), nil
+	}
+	if claims, err := validateToken(token, "refresh", 0); err == nil {
+		tokenID, _ := (*claims)["jti"].(string)
+		filter := bson.D{
+			bson.E{Key: "jti", Value: tokenID},
+			bson.E{Key: "used", Value: false},
+			bson.E{Key: "revoked", Value: false},
+		}
+		record, err := s.tokens.FindRefreshToken(ctx, &filter)
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			return inactive, nil
+		}
+		return newIntrospectionResponse(claims, introspectionRefresh), nil
+	}
+	return inactive, nil
+}
+
+// introspect is introspection endpoint of RFC 7662 available to resource servers.
+// token_type_hint is ignored since all kinds of tokens are cheap to tell apart.
+func (s *server) introspect(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		sendOAuthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	oauthClient, err := s.authenticateOAuthClient(r)
+	if err != nil {
+		sendOAuthError(w, db.ErrorStatus(err), "server_error", err.Error())
+		return
+	}
+	if oauthClient == nil {
+		sendOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+	if !oauthClient.CanIntrospect {
+		sendOAuthError(w, http.StatusForbidden, "unauthorized_client", "Client is not allowed to introspect tokens")
+		return
+	}
+	resp, err := s.introspectToken(r.Context(), r.PostFormValue("token"))
+	if err != nil {
+		sendOAuthError(w, db.ErrorStatus(err), "server_error", err.Error())
+		return
+	}
+	setNoStoreHeaders(w)
+	utils.SendJSON(w, resp, http.StatusOK)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DenisAltruist/distsys/utils"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const keyFileExt = ".pem"
+
+// signingKey is identified by the name of its PEM file without extension. Keys
+// having only public part are retired: they are used only to verify tokens
+// issued before rotation.
+type signingKey struct {
+	id         string
+	privateKey *rsa.PrivateKey
+	publicKey  *rsa.PublicKey
+}
+
+type keyRing struct {
+	signingKey *signingKey
+	keys       map[string]*signingKey
+}
+
+var keys *keyRing
+
+// loadKeyRing reads every *.pem file from dir. Key used for signing is the one
+// named signingKeyID or, if it is empty, the last by name among private keys.
+func loadKeyRing(dir string, signingKeyID string) (*keyRing, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+keyFileExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	ring := keyRing{keys: make(map[string]*signingKey)}
+	for _, path := range paths {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key := signingKey{id: strings.TrimSuffix(filepath.Base(path), keyFileExt)}
+		if privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(contents); err == nil {
+			key.privateKey = privateKey
+			key.publicKey = &privateKey.PublicKey
+		} else if publicKey, err := jwt.ParseRSAPublicKeyFromPEM(contents); err == nil {
+			key.publicKey = publicKey
+		} else {
+			return nil, fmt.Errorf("Can't parse RSA key from %s", path)
+		}
+		ring.keys[key.id] = &key
+		if key.privateKey != nil && (signingKeyID == "" || signingKeyID == key.id) {
+			ring.signingKey = &key
+		}
+	}
+	if ring.signingKey == nil {
+		return nil, fmt.Errorf("Can't find private signing key in %s", dir)
+	}
+	return &ring, nil
+}
+
+func generateKeyFile(dir string) error {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, time.Now().UTC().Format("20060102150405")+keyFileExt)
+	contents := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	})
+	log.Printf("Generated new signing key %s\n", path)
+	return ioutil.WriteFile(path, contents, 0600)
+}
+
+func initKeyRing() error {
+	dir := os.Getenv("JWT_KEYS_DIR")
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+keyFileExt))
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 && os.Getenv("JWT_GENERATE_MISSING_KEY") == "true" {
+		err = generateKeyFile(dir)
+		if err != nil {
+			return err
+		}
+	}
+	keys, err = loadKeyRing(dir, os.Getenv("JWT_SIGNING_KEY_ID"))
+	if err != nil {
+		return err
+	}
+	log.Printf("Loaded %d keys, signing with %s\n", len(keys.keys), keys.signingKey.id)
+	return nil
+}
+
+func signToken(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = keys.signingKey.id
+	return token.SignedString(keys.signingKey.privateKey)
+}
+
+func getVerificationKey(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+		return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+	}
+	keyID, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, errors.New("Token has no kid header")
+	}
+	key, ok := keys.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("Unknown key id: %s", keyID)
+	}
+	return key.publicKey, nil
+}
+
+// JSONWebKey is RSA public key in format of RFC 7517
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Modulus   string `json:"n"`
+	Exponent  string `json:"e"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+func (s *server) jwks(w http.ResponseWriter, r *http.Request) {
+	var keySet JSONWebKeySet
+	for _, key := range keys.keys {
+		keySet.Keys = append(keySet.Keys, JSONWebKey{
+			KeyType:   "RSA",
+			Use:       "sig",
+			Algorithm: jwt.SigningMethodRS256.Alg(),
+			KeyID:     key.id,
+			Modulus:   base64.RawURLEncoding.EncodeToString(key.publicKey.N.Bytes()),
+			Exponent:  base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.publicKey.E)).Bytes()),
+		})
+	}
+	sort.Slice(keySet.Keys, func(i, j int) bool { return keySet.Keys[i].KeyID < keySet.Keys[j].KeyID })
+	encodedKeys, err := json.Marshal(&keySet)
+	if err != nil {
+		utils.SendError(w, http.StatusInternalServerError, "Can't encode JSON key set, got an error: %s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	fmt.Fprintf(w, "%s\n", string(encodedKeys))
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/DenisAltruist/distsys/db"
+	"github.com/DenisAltruist/distsys/utils"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// lockoutPolicy locks a key after maxFailures failed sign ins in a row, every next
+// failure doubles lock duration starting from baseDelay up to maxDelay. Failures
+// older than window are forgotten.
+type lockoutPolicy struct {
+	maxFailures int64
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	window      time.Duration
+}
+
+var (
+	accountLockout lockoutPolicy
+	ipLockout      lockoutPolicy
+)
+
+func loadLockoutPolicy(maxFailuresVar string) (lockoutPolicy, error) {
+	var policy lockoutPolicy
+	values := make(map[string]int)
+	for _, name := range []string{maxFailuresVar, "SIGNIN_LOCKOUT_BASE_SECONDS", "SIGNIN_LOCKOUT_MAX_SECONDS", "SIGNIN_ATTEMPTS_WINDOW_SECONDS"} {
+		value, err := strconv.Atoi(os.Getenv(name))
+		if err != nil {
+			return policy, fmt.Errorf("Can't parse %s: %s", name, err.Error())
+		}
+		values[name] = value
+	}
+	policy.maxFailures = int64(values[maxFailuresVar])
+	policy.baseDelay = time.Duration(values["SIGNIN_LOCKOUT_BASE_SECONDS"]) * time.Second
+	policy.maxDelay = time.Duration(values["SIGNIN_LOCKOUT_MAX_SECONDS"]) * time.Second
+	policy.window = time.Duration(values["SIGNIN_ATTEMPTS_WINDOW_SECONDS"]) * time.Second
+	return policy, nil
+}
+
+func initLockoutPolicies() error {
+	var err error
+	accountLockout, err = loadLockoutPolicy("SIGNIN_MAX_FAILURES_PER_ACCOUNT")
+	if err != nil {
+		return err
+	}
+	ipLockout, err = loadLockoutPolicy("SIGNIN_MAX_FAILURES_PER_IP")
+	return err
+}
+
+// attemptsRetention is how long failures are needed after the last one: they are
+// counted within window and the lock they set lasts up to maxDelay
+func attemptsRetention() time.Duration {
+	retention := time.Second
+	for _, policy := range []lockoutPolicy{accountLockout, ipLockout} {
+		if policy.window > retention {
+			retention = policy.window
+		}
+		if policy.maxDelay > retention {
+			retention = policy.maxDelay
+		}
+	}
+	return retention
+}
+
+func (p *lockoutPolicy) lockDuration(failures int64) time.Duration {
+	if failures < p.maxFailures {
+		return 0
+	}
+	factor := math.Pow(2, float64(failures-p.maxFailures))
+	if factor*float64(p.baseDelay) >= float64(p.maxDelay) {
+		return p.maxDelay
+	}
+	return time.Duration(factor * float64(p.baseDelay))
+}
+
+func accountAttemptsKey(email string) string {
+	return "account:" + email
+}
+
+func ipAttemptsKey(ip string) string {
+	return "ip:" + ip
+}
+
+// getLockoutDelay returns time left until all of keys are unlocked
+func (s *server) getLockoutDelay(ctx context.Context, keys ...string) (time.Duration, error) {
+	var lockedUntil time.Time
+	for _, key := range keys {
+		filter := bson.D{bson.E{Key: "key", Value: key}}
+		attempts, err := s.attempts.FindLoginAttempts(ctx, &filter)
+		if err != nil {
+			return 0, err
+		}
+		if attempts != nil && attempts.LockedUntil.After(lockedUntil) {
+			lockedUntil = attempts.LockedUntil
+		}
+	}
+	return time.Until(lockedUntil), nil
+}
+
+// checkLockout writes 429 response with Retry-After if any of keys is locked
+func (s *server) checkLockout(ctx context.Context, w http.ResponseWriter, keys ...string) bool {
+	retryAfter, err := s.getLockoutDelay(ctx, keys...)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't check sign in attempts, got an error: %s", err.Error())
+		return false
+	}
+	if retryAfter <= 0 {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	utils.SendError(w, http.StatusTooManyRequests, "Too many failed sign in attempts, try again later")
+	return false
+}
+
+func (s *server) registerFailure(ctx context.Context, key string, policy *lockoutPolicy) error {
+	before, err := s.attempts.AddFailedLoginAttempt(ctx, key)
+	if err != nil {
+		return err
+	}
+	failures := before.Failures + 1
+	filter := bson.D{bson.E{Key: "key", Value: key}}
+	fields := bson.D{}
+	if time.Since(before.UpdatedAt) > policy.window {
+		failures = 1
+		fields = append(fields, bson.E{Key: "failures", Value: failures})
+	}
+	if lockDuration := policy.lockDuration(failures); lockDuration > 0 {
+		fields = append(fields, bson.E{Key: "locked_until", Value: time.Now().Add(lockDuration)})
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	update := bson.D{bson.E{Key: "$set", Value: fields}}
+	return s.attempts.UpdateLoginAttempts(ctx, &filter, &update)
+}
+
+// registerFailedSignIn isn't bound to the request, so failures are counted even
+// if the client disconnects right after sending the password
+func (s *server) registerFailedSignIn(email string, ip string) {
+	if err := s.registerFailure(context.Background(), accountAttemptsKey(email), &accountLockout); err != nil {
+		log.Printf("Can't register failed sign in of %s: %s\n", email, err.Error())
+	}
+	if err := s.registerFailure(context.Background(), ipAttemptsKey(ip), &ipLockout); err != nil {
+		log.Printf("Can't register failed sign in from %s: %s\n", ip, err.Error())
+	}
+}
+
+func (s *server) resetFailedSignIns(email string) {
+	filter := bson.D{bson.E{Key: "key", Value: accountAttemptsKey(email)}}
+	if _, err := s.attempts.RemoveLoginAttempts(context.Background(), &filter); err != nil {
+		log.Printf("Can't reset failed sign ins of %s: %s\n", email, err.Error())
+	}
+}
+
+// unlockAccount lets admins remove lock of the account (email argument) or of the client IP (ip argument)
+func (s *server) unlockAccount(w http.ResponseWriter, r *http.Request) {
+	if s.authorizeRequest(w, r, db.RoleAdmin) == nil {
+		return
+	}
+	var keys []string
+	if email := canonicalEmail(r.FormValue("email")); len(email) != 0 {
+		setAuditTarget(r, email)
+		keys = append(keys, accountAttemptsKey(email))
+	}
+	if ip := r.FormValue("ip"); len(ip) != 0 {
+		keys = append(keys, ipAttemptsKey(ip))
+	}
+	if len(keys) == 0 {
+		utils.SendError(w, http.StatusBadRequest, "Neither 'email' nor 'ip' argument is specified")
+		return
+	}
+	filter := bson.D{bson.E{Key: "key", Value: bson.D{bson.E{Key: "$in", Value: keys}}}}
+	_, err := s.attempts.RemoveLoginAttempts(r.Context(), &filter)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't unlock, got an error: %s", err.Error())
+		return
+	}
+	utils.SendBodyResponse(w, "Unlocked", http.StatusOK)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestLockDuration(t *testing.T) {
+	policy := lockoutPolicy{maxFailures: 3, baseDelay: 10 * time.Second, maxDelay: time.Minute, window: time.Hour}
+	tests := []struct {
+		failures int64
+		want     time.Duration
+	}{
+		{failures: 0, want: 0},
+		{failures: 2, want: 0},
+		{failures: 3, want: 10 * time.Second},
+		{failures: 4, want: 20 * time.Second},
+		{failures: 5, want: 40 * time.Second},
+		{failures: 6, want: time.Minute},
+		{failures: 100, want: time.Minute},
+		{failures: 5000, want: time.Minute},
+	}
+	for _, tt := range tests {
+		if got := policy.lockDuration(tt.failures); got != tt.want {
+			t.Errorf("Lock after %d failures = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestRegisterFailureWindow(t *testing.T) {
+	ctx := context.Background()
+	policy := lockoutPolicy{maxFailures: 2, baseDelay: time.Minute, maxDelay: time.Hour, window: time.Hour}
+	tests := []struct {
+		name         string
+		sinceLast    time.Duration
+		wantFailures int64
+		wantLocked   bool
+	}{
+		{name: "first failure", wantFailures: 1},
+		{name: "failure within window", sinceLast: time.Minute, wantFailures: 2, wantLocked: true},
+		{name: "next failure within window", sinceLast: time.Minute, wantFailures: 3, wantLocked: true},
+		{name: "failure after window", sinceLast: 2 * time.Hour, wantFailures: 1},
+		{name: "failure within new window", sinceLast: time.Minute, wantFailures: 2, wantLocked: true},
+	}
+	s := newTestServer(t)
+	key := accountAttemptsKey("alice@example.com")
+	filter := bson.D{bson.E{Key: "key", Value: key}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.sinceLast != 0 {
+				// the previous failure happened sinceLast ago and its lock is over
+				update := bson.D{bson.E{Key: "$set", Value: bson.D{
+					bson.E{Key: "updated_at", Value: time.Now().Add(-tt.sinceLast)},
+					bson.E{Key: "locked_until", Value: time.Time{}},
+				}}}
+				if err := s.attempts.UpdateLoginAttempts(ctx, &filter, &update); err != nil {
+					t.Fatalf("Can't move failures to the past: %s", err.Error())
+				}
+			}
+			if err := s.registerFailure(ctx, key, &policy); err != nil {
+				t.Fatalf("Can't register failure: %s", err.Error())
+			}
+			attempts, err := s.attempts.FindLoginAttempts(ctx, &filter)
+			if err != nil || attempts == nil {
+				t.Fatalf("Got attempts %+v with error %v", attempts, err)
+			}
+			if attempts.Failures != tt.wantFailures {
+				t.Errorf("Failures = %d, want %d", attempts.Failures, tt.wantFailures)
+			}
+			delay, err := s.getLockoutDelay(ctx, key)
+			if err != nil {
+				t.Fatalf("Can't get lockout delay: %s", err.Error())
+			}
+			if (delay > 0) != tt.wantLocked {
+				t.Errorf("Locked for %v, want locked: %t", delay, tt.wantLocked)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mailer delivers plain text emails to users
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+var mailer Mailer
+
+func composeMessage(from string, to string, subject string, body string) []byte {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return msg.Bytes()
+}
+
+// outboxMailer writes every email into a separate file of the directory instead
+// of sending it, to be used in local development and tests
+type outboxMailer struct {
+	dir  string
+	from string
+}
+
+func (m *outboxMailer) Send(to string, subject string, body string) error {
+	err := os.MkdirAll(m.dir, 0700)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.Replace(to, string(filepath.Separator), "_", -1))
+	path := filepath.Join(m.dir, name)
+	log.Printf("Writing email for %s to %s\n", to, path)
+	return ioutil.WriteFile(path, composeMessage(m.from, to, subject, body), 0600)
+}
+
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m *smtpMailer) Send(to string, subject string, body string) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, composeMessage(m.from, to, subject, body))
+}
+
+func newMailer() (Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	switch mailerType := os.Getenv("MAILER"); mailerType {
+	case "", "outbox":
+		return &outboxMailer{dir: os.Getenv("MAIL_OUTBOX_DIR"), from: from}, nil
+	case "smtp":
+		addr := os.Getenv("SMTP_ADDR")
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("Can't parse SMTP_ADDR: %s", err.Error())
+		}
+		var auth smtp.Auth
+		if username := os.Getenv("SMTP_USERNAME"); username != "" {
+			auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+		}
+		return &smtpMailer{addr: addr, from: from, auth: auth}, nil
+	default:
+		return nil, fmt.Errorf("Unknown mailer type: %s", mailerType)
+	}
+}
@@ -1,18 +1,23 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
-	"crypto/md5"
-
 	"github.com/DenisAltruist/distsys/db"
 	"github.com/DenisAltruist/distsys/utils"
 	jwt "github.com/dgrijalva/jwt-go"
@@ -20,9 +25,30 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 )
 
-func calcPassHash(password string) string {
-	bytes := md5.Sum([]byte(password))
-	return string(bytes[:])
+// server holds dependencies shared by handlers
+type server struct {
+	users       db.UserRepository
+	tokens      db.TokenRepository
+	sessions    db.SessionRepository
+	revocations db.RevocationRepository
+	attempts    db.AttemptRepository
+	apiKeys     db.APIKeyRepository
+	clients     db.OAuthClientRepository
+	auditEvents db.AuditRepository
+	audit       *auditWriter
+}
+
+func newServer(repos *db.AuthRepositories) *server {
+	return &server{
+		users:       repos.Users,
+		tokens:      repos.Tokens,
+		sessions:    repos.Sessions,
+		revocations: repos.Revocations,
+		attempts:    repos.Attempts,
+		apiKeys:     repos.APIKeys,
+		clients:     repos.Clients,
+		auditEvents: repos.Audit,
+	}
 }
 
 func elapsed(what string) func() {
@@ -32,38 +58,118 @@ func elapsed(what string) func() {
 	}
 }
 
-func comparePass(password string, hash string) bool {
-	hashByPass := calcPassHash(password)
-	if hashByPass != hash {
-		return false
+func randomHex(numBytes int) (string, error) {
+	bytes := make([]byte, numBytes)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
 	}
-	return true
+	return hex.EncodeToString(bytes), nil
 }
 
-func issueTokens(email string) (*db.TokensPair, error) {
+// hashSecret is used for random high-entropy secrets, e.g. one-time tokens, which
+// need no salt or slow hashing unlike passwords
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func newTokenID() (string, error) {
+	return randomHex(16)
+}
+
+// issueTokens issues new pair of tokens and stores refresh token record. Empty familyID
+// starts a new family, i.e. new sign in, and a new session of the user.
+func (s *server) issueTokens(user *db.ShopUser, familyID string, grant *oauthGrant, r *http.Request) (*db.TokensPair, error) {
+	email := user.Email
+	roles := user.Roles
+	if grant != nil {
+		roles = grant.roles(user)
+	}
 	accessTokenDur, err := strconv.Atoi(os.Getenv("ACCESS_TOKENS_DURATION_MINUTES"))
 	if err != nil {
 		return nil, err
 	}
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	accessTokenID, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	accessTokenExp := time.Now().Add(time.Minute * time.Duration(accessTokenDur))
+	isNewSession := familyID == ""
+	if isNewSession {
+		familyID, err = newTokenID()
+		if err != nil {
+			return nil, err
+		}
+	}
+	accessToken := jwt.MapClaims{
+		"sub":   email,
 		"email": email,
 		"type":  "access",
-		"exp":   time.Now().Add(time.Minute * time.Duration(accessTokenDur)).Unix(),
-	})
+		"roles": roles,
+		"sid":   familyID,
+		"jti":   accessTokenID,
+		"iat":   time.Now().Unix(),
+		"exp":   accessTokenExp.Unix(),
+	}
 	refreshTokenDur, err := strconv.Atoi(os.Getenv("REFRESH_TOKENS_DURATION_MINUTES"))
 	if err != nil {
 		return nil, err
 	}
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	refreshTokenID, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	refreshTokenExp := time.Now().Add(time.Minute * time.Duration(refreshTokenDur))
+	refreshToken := jwt.MapClaims{
 		"email": email,
 		"type":  "refresh",
-		"exp":   time.Now().Add(time.Minute * time.Duration(refreshTokenDur)).Unix(),
+		"jti":   refreshTokenID,
+		"iat":   time.Now().Unix(),
+		"exp":   refreshTokenExp.Unix(),
+	}
+	at, err := signToken(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	rt, err := signToken(refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	err = s.tokens.AddRefreshToken(r.Context(), &db.RefreshTokenRecord{
+		ID:              refreshTokenID,
+		FamilyID:        familyID,
+		Email:           email,
+		ExpiresAt:       refreshTokenExp,
+		AccessTokenID:   accessTokenID,
+		AccessExpiresAt: accessTokenExp,
+		ClientID:        grant.getClientID(),
+		Scope:           grant.getScope(),
 	})
-	at, err := accessToken.SignedString([]byte(os.Getenv("JWT_HS256_SECRET")))
 	if err != nil {
 		return nil, err
 	}
-	rt, err := refreshToken.SignedString([]byte(os.Getenv("JWT_HS256_SECRET")))
+	clientIP := getClientIP(r)
+	if isNewSession {
+		err = s.sessions.AddSession(r.Context(), &db.Session{
+			ID:              familyID,
+			Email:           email,
+			UserAgent:       r.UserAgent(),
+			IP:              clientIP,
+			LastIP:          clientIP,
+			CreatedAt:       time.Now(),
+			LastRefreshedAt: time.Now(),
+			ExpiresAt:       refreshTokenExp,
+		})
+	} else {
+		filter := bson.D{bson.E{Key: "session_id", Value: familyID}}
+		update := bson.D{bson.E{Key: "$set", Value: bson.D{
+			bson.E{Key: "last_ip", Value: clientIP},
+			bson.E{Key: "user_agent", Value: r.UserAgent()},
+			bson.E{Key: "last_refreshed_at", Value: time.Now()},
+			bson.E{Key: "expires_at", Value: refreshTokenExp},
+		}}}
+		_, err = s.sessions.UpdateSessions(r.Context(), &filter, &update)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -71,19 +177,14 @@ func issueTokens(email string) (*db.TokensPair, error) {
 		AccessToken:  at,
 		RefreshToken: rt,
 		Email:        email,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(accessTokenDur) * 60,
+		Scope:        strings.Join(roles, " "),
 	}, nil
 }
 
 func validateToken(token string, wantTokenType string, duration time.Duration) (*jwt.MapClaims, error) {
-	decodedToken, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-		// Don't forget to validate the alg is what you expect:
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
-
-		// hmacSampleSecret is a []byte containing your secret, e.g. []byte("my_secret_key")
-		return []byte(os.Getenv("JWT_HS256_SECRET")), nil
-	})
+	decodedToken, err := jwt.Parse(token, getVerificationKey)
 	if err != nil {
 		return nil, err
 	}
@@ -98,76 +199,182 @@ func validateToken(token string, wantTokenType string, duration time.Duration) (
 	return nil, errors.New("Can't convert jwt claims to map")
 }
 
-func getShopUserFromReq(w http.ResponseWriter, r *http.Request) (*db.ShopUser, bool) {
-	contents, err := ioutil.ReadAll(r.Body)
+// rehashPassword silently replaces stored hash of the user with the one in current format,
+// failures are only logged since user has already proven the password.
+func (s *server) rehashPassword(ctx context.Context, email string, password string) {
+	newHash, err := calcPassHash(password)
 	if err != nil {
-		utils.SendError(w, http.StatusBadRequest, "Can't parse request body, got error: %s", err.Error())
-		return nil, false
+		log.Printf("Can't rehash password of %s: %s\n", email, err.Error())
+		return
 	}
-	var user db.ShopUser
-	err = json.Unmarshal(contents, &user)
+	filter := bson.D{bson.E{Key: "email", Value: email}}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "password_hash", Value: newHash}}}}
+	_, err = s.users.UpdateUser(ctx, &filter, &update)
+	if err != nil {
+		log.Printf("Can't store rehashed password of %s: %s\n", email, err.Error())
+	}
+}
+
+// getClientIP returns address of the client, X-Forwarded-For is used only
+// when the service is configured to run behind a trusted proxy
+func getClientIP(r *http.Request) string {
+	if os.Getenv("TRUST_FORWARDED_FOR") == "true" {
+		if forwardedFor := r.Header.Get("X-Forwarded-For"); len(forwardedFor) != 0 {
+			return strings.TrimSpace(strings.Split(forwardedFor, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		utils.SendError(w, http.StatusBadRequest, "Can't unrmashal contents %s, expected valid JSON", string(contents))
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func getShopUserFromReq(w http.ResponseWriter, r *http.Request) (*db.ShopUser, bool) {
+	var user db.ShopUser
+	if !utils.ReadJSON(w, r, &user) {
 		return nil, false
 	}
+	user.Email = canonicalEmail(user.Email)
+	setAuditEmail(r, user.Email)
 	return &user, true
 }
 
-func signUp(w http.ResponseWriter, r *http.Request) {
+func (s *server) signUp(w http.ResponseWriter, r *http.Request) {
 	newUser, ok := getShopUserFromReq(w, r)
 	if !ok {
 		return
 	}
-	passwordHash := calcPassHash(newUser.Password)
-	client, ok := db.GetDbClient(w)
-	if !ok {
+	email, errs := checkEmail("email", newUser.Email)
+	errs = append(errs, passwordRules.check("password", newUser.Password, email)...)
+	if sendFieldErrors(w, errs) {
 		return
 	}
-	filter := bson.D{bson.E{Key: "email", Value: newUser.Email}}
-	sameUser, err := db.FindUser(client, &filter, 5*time.Second)
+	newUser.Email = email
+	passwordHash, err := calcPassHash(newUser.Password)
 	if err != nil {
-		utils.SendError(w, http.StatusInternalServerError, "Can't check existance user in database, got an error: %s", err.Error())
+		utils.SendError(w, http.StatusInternalServerError, "Can't calculate password hash, got an error: %s", err.Error())
 		return
 	}
-	if sameUser != nil {
-		utils.SendError(w, http.StatusBadRequest, "This email is already registered")
+	newShopUser := db.ShopUser{
+		PasswordHash: passwordHash,
+		Email:        newUser.Email,
+		Roles:        []string{db.RoleViewer},
+		Status:       db.UserStatusPending,
+	}
+	err = s.users.AddNewUser(r.Context(), &newShopUser)
+	if db.IsDuplicateKeyError(err) { // emails are unique by index
+		utils.SendError(w, http.StatusConflict, "This email is already registered")
 		return
 	}
-	err = db.AddNewUser(client, &db.ShopUser{PasswordHash: passwordHash, Email: newUser.Email}, time.Second*5)
 	if err != nil {
-		utils.SendError(w, http.StatusInternalServerError, "Can't sign up new user, got an error: %s", err.Error())
+		utils.SendError(w, db.ErrorStatus(err), "Can't sign up new user, got an error: %s", err.Error())
 		return
 	}
-	utils.SendBodyResponse(w, "Successfully signed up!", http.StatusOK)
+	err = s.sendVerificationEmail(r.Context(), newShopUser.Email)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Signed up, but can't send verification email, got an error: %s", err.Error())
+		return
+	}
+	utils.SendBodyResponse(w, "Successfully signed up! Check your email to verify it", http.StatusOK)
 }
 
-func signIn(w http.ResponseWriter, r *http.Request) {
-	user, ok := getShopUserFromReq(w, r)
+// credentialsError is caused by credentials presented by the client as opposed to
+// internal failures, code is the status returned by the native API
+type credentialsError struct {
+	code       int
+	message    string
+	retryAfter time.Duration
+	// oauthError is the error code of token endpoint, invalid_grant if empty
+	oauthError string
+}
+
+func (e *credentialsError) Error() string {
+	return e.message
+}
+
+func sendCredentialsError(w http.ResponseWriter, err error) {
+	credErr, ok := err.(*credentialsError)
 	if !ok {
+		utils.SendError(w, db.ErrorStatus(err), "Can't check credentials, got an error: %s", err.Error())
 		return
 	}
-	client, ok := db.GetDbClient(w)
-	if !ok {
-		return
+	if credErr.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(credErr.retryAfter.Seconds()))))
+	}
+	utils.SendError(w, credErr.code, credErr.message)
+}
+
+// checkCredentials finds user by email and password, failed attempts are counted
+// for lockout
+func (s *server) checkCredentials(ctx context.Context, email string, password string, clientIP string) (*db.ShopUser, error) {
+	retryAfter, err := s.getLockoutDelay(ctx, accountAttemptsKey(email), ipAttemptsKey(clientIP))
+	if err != nil {
+		return nil, err
+	}
+	if retryAfter > 0 {
+		return nil, &credentialsError{
+			code:       http.StatusTooManyRequests,
+			message:    "Too many failed sign in attempts, try again later",
+			retryAfter: retryAfter,
+		}
+	}
+	foundUser, err := s.users.FindUser(ctx, email)
+	if err != nil {
+		return nil, err
 	}
-	filter := bson.D{bson.E{Key: "email", Value: user.Email}}
-	foundUser, err := db.FindUser(client, &filter, 5*time.Second)
+	signedIn, needsRehash := false, false
+	if foundUser != nil {
+		signedIn, needsRehash = comparePass(password, foundUser.PasswordHash)
+	} else {
+		comparePass(password, dummyPassHash)
+	}
+	if !signedIn {
+		s.registerFailedSignIn(email, clientIP)
+		return nil, &credentialsError{code: http.StatusNotFound, message: "Can't find user with pair (email, password)"}
+	}
+	s.resetFailedSignIns(foundUser.Email)
+	if needsRehash {
+		s.rehashPassword(ctx, foundUser.Email, password)
+	}
+	err = checkUserStatus(foundUser)
 	if err != nil {
-		utils.SendError(w, http.StatusInternalServerError, "Got an error on find user: %s", err.Error())
+		return nil, err
+	}
+	return foundUser, nil
+}
+
+// checkUserStatus rejects users who proved credentials, but can't sign in
+func checkUserStatus(user *db.ShopUser) error {
+	if user.Status == db.UserStatusPending {
+		return &credentialsError{code: http.StatusForbidden, message: "Email is not verified"}
+	}
+	if user.Status == db.UserStatusDisabled {
+		return &credentialsError{code: http.StatusForbidden, message: "Account is disabled"}
+	}
+	if user.PasswordResetRequired {
+		return &credentialsError{code: http.StatusForbidden, message: "Password has to be reset, check your email"}
+	}
+	return nil
+}
+
+func (s *server) signIn(w http.ResponseWriter, r *http.Request) {
+	user, ok := getShopUserFromReq(w, r)
+	if !ok {
 		return
 	}
-	if foundUser == nil {
-		utils.SendError(w, http.StatusBadRequest, "Can't find user with pair (email, password)")
+	foundUser, err := s.checkCredentials(r.Context(), user.Email, user.Password, getClientIP(r))
+	if err != nil {
+		sendCredentialsError(w, err)
 		return
 	}
-	signedIn := comparePass(user.Password, foundUser.PasswordHash)
-	if !signedIn {
-		utils.SendError(w, http.StatusNotFound, "Can't find user with pair (email, password)")
+	if foundUser.TOTPEnabled {
+		sendTwoFactorChallenge(w, foundUser)
 		return
 	}
-	tokens, err := issueTokens(user.Email)
+	tokens, err := s.issueTokens(foundUser, "", nil, r)
 	if err != nil {
-		utils.SendError(w, http.StatusInternalServerError, "Can't issue tokens pair, got an error: %s", err.Error())
+		utils.SendError(w, db.ErrorStatus(err), "Can't issue tokens pair, got an error: %s", err.Error())
 		return
 	}
 	encodedTokens, err := json.Marshal(&tokens)
@@ -197,14 +404,121 @@ func validateEncodedToken(w http.ResponseWriter, token string, tokenType string)
 	return claims
 }
 
-func refresh(w http.ResponseWriter, r *http.Request) {
-	claims := validateEncodedToken(w, r.FormValue("token"), "refresh")
-	if claims == nil { // Response is already written in 'w'
-		return
+// revokeSessions revokes refresh tokens matching the filter together with
+// access tokens issued with them which are not expired yet and their sessions.
+// Cancelled ctx may leave part of them not revoked, so callers which have
+// already changed something pass context.Background(), db timeouts still apply
+func (s *server) revokeSessions(ctx context.Context, filter *bson.D) error {
+	records, err := s.tokens.FindRefreshTokens(ctx, filter)
+	if err != nil {
+		return err
+	}
+	revoke := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "revoked", Value: true}}}}
+	_, err = s.tokens.UpdateRefreshTokens(ctx, filter, &revoke)
+	if err != nil {
+		return err
+	}
+	var familyIDs []string
+	var revokedTokens []*db.RevokedToken
+	for _, record := range records {
+		familyIDs = append(familyIDs, record.FamilyID)
+		if record.AccessTokenID == "" || record.AccessExpiresAt.Before(time.Now()) {
+			continue
+		}
+		revokedTokens = append(revokedTokens, &db.RevokedToken{
+			ID:        record.AccessTokenID,
+			Email:     record.Email,
+			ExpiresAt: record.AccessExpiresAt,
+		})
 	}
-	tokens, err := issueTokens((*claims)["email"].(string))
+	err = s.revocations.AddRevokedTokens(ctx, revokedTokens)
+	if err != nil || len(familyIDs) == 0 {
+		return err
+	}
+	sessionsFilter := bson.D{bson.E{Key: "session_id", Value: bson.D{bson.E{Key: "$in", Value: familyIDs}}}}
+	_, err = s.sessions.UpdateSessions(ctx, &sessionsFilter, &revoke)
+	return err
+}
+
+// useRefreshToken marks refresh token as used and returns its record. Presenting
+// already used token means it was leaked, so the whole family gets revoked.
+func (s *server) useRefreshToken(ctx context.Context, claims *jwt.MapClaims, grant *oauthGrant) (*db.RefreshTokenRecord, error) {
+	tokenID, ok := (*claims)["jti"].(string)
+	if !ok {
+		return nil, &credentialsError{code: http.StatusUnauthorized, message: "Token is expired or not correct: missing jti"}
+	}
+	recordFilter := bson.D{bson.E{Key: "jti", Value: tokenID}}
+	record, err := s.tokens.FindRefreshToken(ctx, &recordFilter)
 	if err != nil {
-		utils.SendError(w, http.StatusInternalServerError, "Can't issue tokens pair, got an error: %s", err.Error())
+		return nil, err
+	}
+	if record == nil {
+		return nil, &credentialsError{code: http.StatusUnauthorized, message: "Refresh token is unknown"}
+	}
+	// checked before the token is used, so that another client can't spend it
+	if record.ClientID != grant.getClientID() {
+		return nil, &credentialsError{code: http.StatusUnauthorized, message: "Refresh token was issued to another client"}
+	}
+	if grant != nil && record.Scope != nil && !containsAll(record.Scope, grant.scope) {
+		return nil, &credentialsError{code: http.StatusBadRequest, message: "Scope exceeds the one granted originally", oauthError: "invalid_scope"}
+	}
+	filter := bson.D{
+		bson.E{Key: "jti", Value: tokenID},
+		bson.E{Key: "used", Value: false},
+		bson.E{Key: "revoked", Value: false},
+	}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "used", Value: true}}}}
+	matched, err := s.tokens.UpdateRefreshTokens(ctx, &filter, &update)
+	if err != nil {
+		return nil, err
+	}
+	if matched == 0 {
+		log.Printf("Reuse of refresh token %s detected, revoking family %s\n", tokenID, record.FamilyID)
+		familyFilter := bson.D{bson.E{Key: "family_id", Value: record.FamilyID}}
+		// the one who presented the stolen token must not stop it by disconnecting
+		err = s.revokeSessions(context.Background(), &familyFilter)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &credentialsError{code: http.StatusUnauthorized, message: "Refresh token has already been used or revoked"}
+	}
+	return record, nil
+}
+
+// rotateRefreshToken exchanges refresh token for a new pair of tokens of the
+// same family. Tokens issued to OAuth client are refreshed only by that client
+// and keep their scope unless it's narrowed, the rest only by /refresh with nil grant
+func (s *server) rotateRefreshToken(token string, grant *oauthGrant, r *http.Request) (*db.TokensPair, error) {
+	claims, err := validateToken(token, "refresh", 0)
+	if err != nil {
+		return nil, &credentialsError{code: http.StatusUnauthorized, message: "Token is expired or not correct: " + err.Error()}
+	}
+	record, err := s.useRefreshToken(r.Context(), claims, grant)
+	if err != nil {
+		return nil, err
+	}
+	email, _ := (*claims)["email"].(string)
+	setAuditEmail(r, email)
+	user, err := s.users.FindUser(r.Context(), email)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, &credentialsError{code: http.StatusUnauthorized, message: "User doesn't exist anymore"}
+	}
+	if user.Status == db.UserStatusDisabled {
+		return nil, &credentialsError{code: http.StatusForbidden, message: "Account is disabled"}
+	}
+	if grant != nil && grant.scope == nil {
+		grant.scope = record.Scope
+	}
+	return s.issueTokens(user, record.FamilyID, grant, r)
+}
+
+func (s *server) refresh(w http.ResponseWriter, r *http.Request) {
+	tokens, err := s.rotateRefreshToken(r.FormValue("token"), nil, r)
+	if err != nil {
+		sendCredentialsError(w, err)
 		return
 	}
 	encodedTokens, err := json.Marshal(&tokens)
@@ -216,19 +530,221 @@ func refresh(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s\n", string(encodedTokens))
 }
 
-func validate(w http.ResponseWriter, r *http.Request) {
-	claims := validateEncodedToken(w, r.FormValue("token"), "access")
+func (s *server) signOut(w http.ResponseWriter, r *http.Request) {
+	claims := validateEncodedToken(w, r.FormValue("token"), "refresh")
+	if claims == nil {
+		return
+	}
+	email, _ := (*claims)["email"].(string)
+	setAuditEmail(r, email)
+	tokenID, ok := (*claims)["jti"].(string)
+	if !ok {
+		utils.SendError(w, http.StatusUnauthorized, "Token is expired or not correct: missing jti")
+		return
+	}
+	filter := bson.D{bson.E{Key: "jti", Value: tokenID}}
+	record, err := s.tokens.FindRefreshToken(r.Context(), &filter)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't find refresh token, got an error: %s", err.Error())
+		return
+	}
+	if record == nil {
+		utils.SendError(w, http.StatusUnauthorized, "Refresh token is unknown")
+		return
+	}
+	familyFilter := bson.D{bson.E{Key: "family_id", Value: record.FamilyID}}
+	// nothing is changed before, so the client retries if it gives up in between
+	err = s.revokeSessions(r.Context(), &familyFilter)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't revoke tokens, got an error: %s", err.Error())
+		return
+	}
+	utils.SendBodyResponse(w, "Successfully signed out", http.StatusOK)
+}
+
+func (s *server) signOutAll(w http.ResponseWriter, r *http.Request) {
+	claims := validateEncodedToken(w, r.FormValue("token"), "refresh")
 	if claims == nil {
 		return
 	}
-	utils.SendBodyResponse(w, "Authorized", http.StatusOK)
+	email, _ := (*claims)["email"].(string)
+	setAuditEmail(r, email)
+	filter := bson.D{bson.E{Key: "email", Value: email}}
+	err := s.revokeSessions(r.Context(), &filter)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't revoke tokens, got an error: %s", err.Error())
+		return
+	}
+	utils.SendBodyResponse(w, "Successfully signed out of all devices", http.StatusOK)
+}
+
+// connectStore connects to mongo and migrates users and indexes of auth collections
+func connectStore(retention *db.AuthRetention) *db.Store {
+	storeConfig, err := db.LoadStoreConfig()
+	if err != nil {
+		log.Fatalf("Can't load database config: %s", err.Error())
+	}
+	store, err := db.NewStore(storeConfig)
+	if err != nil {
+		log.Fatalf("Can't connect to database: %s", err.Error())
+	}
+	client := store.Client()
+	migrated, conflicts, err := db.CanonicalizeUserEmails(context.Background(), client)
+	if err != nil {
+		log.Fatalf("Can't migrate emails of users to canonical form: %s", err.Error())
+	}
+	if migrated != 0 {
+		log.Printf("Migrated emails of %d users to canonical form\n", migrated)
+	}
+	for _, email := range conflicts {
+		log.Printf("User %s differs only in case from another user and can't sign in, merge or remove one of them by hand\n", email)
+	}
+	migratedRoles, err := db.AssignDefaultRoles(context.Background(), client)
+	if err != nil {
+		log.Fatalf("Can't assign default roles to users: %s", err.Error())
+	}
+	if migratedRoles != 0 {
+		log.Printf("Assigned %s role to %d users without roles\n", db.RoleViewer, migratedRoles)
+	}
+	// emails are canonical after the migration above, so legacy users can't break the index
+	err = db.EnsureUsersIndexes(context.Background(), client)
+	if err != nil {
+		log.Fatalf("Can't create users indexes: %s", err.Error())
+	}
+	err = db.EnsureRevocationsIndexes(context.Background(), client)
+	if err != nil {
+		log.Fatalf("Can't create revocations indexes: %s", err.Error())
+	}
+	err = db.EnsureTokensIndexes(context.Background(), client)
+	if err != nil {
+		log.Fatalf("Can't create refresh tokens indexes: %s", err.Error())
+	}
+	err = db.EnsureSessionsIndexes(context.Background(), client)
+	if err != nil {
+		log.Fatalf("Can't create sessions indexes: %s", err.Error())
+	}
+	err = db.EnsureAttemptsIndexes(context.Background(), client, retention.Attempts)
+	if err != nil {
+		log.Fatalf("Can't create sign in attempts indexes: %s", err.Error())
+	}
+	err = db.EnsureAuditIndexes(context.Background(), client, retention.Audit)
+	if err != nil {
+		log.Fatalf("Can't create audit indexes: %s", err.Error())
+	}
+	return store
 }
 
 func main() {
+	storeType := flag.String("store", "mongo", "where users and tokens are stored: mongo, bolt or memory")
+	boltPath := flag.String("bolt-path", "auth.db", "file of the embedded storage for -store=bolt")
+	flag.Parse()
+	err := initKeyRing()
+	if err != nil {
+		log.Fatalf("Can't load JWT signing keys: %s", err.Error())
+	}
+	mailer, err = newMailer()
+	if err != nil {
+		log.Fatalf("Can't create mailer: %s", err.Error())
+	}
+	err = initLockoutPolicies()
+	if err != nil {
+		log.Fatalf("Can't load sign in lockout config: %s", err.Error())
+	}
+	err = initPasswordPolicy()
+	if err != nil {
+		log.Fatalf("Can't load password policy: %s", err.Error())
+	}
+	retention := db.AuthRetention{Attempts: attemptsRetention()}
+	retention.Audit, err = auditRetention()
+	if err != nil {
+		log.Fatalf("Can't init audit log: %s", err.Error())
+	}
+	var store *db.Store
+	var boltStore *db.BoltStore
+	var repos *db.AuthRepositories
+	switch *storeType {
+	case "mongo":
+		store = connectStore(&retention)
+		repos = db.NewMongoAuthRepositories(store.Client())
+	case "bolt":
+		boltStore, err = db.OpenBoltStore(*boltPath)
+		if err != nil {
+			log.Fatalf("Can't open embedded storage %s: %s", *boltPath, err.Error())
+		}
+		repos, err = boltStore.Auth(&retention)
+		if err != nil {
+			log.Fatalf("Can't create auth collections in %s: %s", *boltPath, err.Error())
+		}
+	case "memory":
+		log.Printf("Users and tokens are kept in memory and will be lost on exit\n")
+		repos = db.NewMemoryAuthRepositories(&retention)
+	default:
+		log.Fatalf("Unknown store: %s", *storeType)
+	}
+	s := newServer(repos)
+	if adminEmail := os.Getenv("AUTH_BOOTSTRAP_ADMIN_EMAIL"); len(adminEmail) != 0 {
+		found, err := db.GrantRole(context.Background(), s.users, adminEmail, db.RoleAdmin)
+		if err != nil {
+			log.Fatalf("Can't grant %s role to %s: %s", db.RoleAdmin, adminEmail, err.Error())
+		}
+		if !found {
+			log.Printf("User %s from AUTH_BOOTSTRAP_ADMIN_EMAIL is not signed up yet, restart after sign up to grant %s role\n", adminEmail, db.RoleAdmin)
+		}
+	}
+	s.audit = newAuditWriter(s.auditEvents)
+	err = s.bootstrapIntrospectionClient(context.Background())
+	if err != nil {
+		log.Fatalf("Can't register introspection client: %s", err.Error())
+	}
 	router := mux.NewRouter()
-	router.HandleFunc("/signup", signUp).Methods("POST")
-	router.HandleFunc("/signin", signIn).Methods("PUT")
-	router.HandleFunc("/refresh", refresh).Methods("PUT")
-	router.HandleFunc("/validate", validate).Methods("GET")
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", os.Getenv("INTERNAL_LISTEN_PORT")), router))
+	router.HandleFunc("/signup", s.signUp).Methods("POST").Name("signup")
+	router.HandleFunc("/signin", s.signIn).Methods("PUT").Name("signin")
+	router.HandleFunc("/signin/2fa", s.signInTwoFactor).Methods("PUT").Name("signin_2fa")
+	router.HandleFunc("/refresh", s.refresh).Methods("PUT").Name("refresh")
+	router.HandleFunc("/verify-email", s.verifyEmail).Methods("GET").Name("verify_email")
+	router.HandleFunc("/verify-email/resend", s.resendVerificationEmail).Methods("PUT").Name("verify_email_resend")
+	router.HandleFunc("/password/forgot", s.forgotPassword).Methods("POST").Name("password_forgot")
+	router.HandleFunc("/password/reset", s.resetPassword).Methods("POST").Name("password_reset")
+	router.HandleFunc("/2fa/enroll", s.enrollTwoFactor).Methods("POST").Name("2fa_enroll")
+	router.HandleFunc("/2fa/confirm", s.confirmTwoFactor).Methods("POST").Name("2fa_confirm")
+	router.HandleFunc("/2fa", s.disableTwoFactor).Methods("DELETE").Name("2fa_disable")
+	router.HandleFunc("/password", s.changePassword).Methods("PUT").Name("password_change")
+	router.HandleFunc("/account", s.deleteAccount).Methods("DELETE").Name("account_delete")
+	router.HandleFunc("/sessions", s.listSessions).Methods("GET").Name("sessions_list")
+	router.HandleFunc("/sessions", s.revokeSession).Methods("DELETE").Name("session_revoke")
+	router.HandleFunc("/apikeys", s.createAPIKey).Methods("POST").Name("apikey_create")
+	router.HandleFunc("/apikeys", s.listAPIKeys).Methods("GET").Name("apikeys_list")
+	router.HandleFunc("/apikeys", s.revokeAPIKey).Methods("DELETE").Name("apikey_revoke")
+	router.HandleFunc("/signout", s.signOut).Methods("PUT").Name("signout")
+	router.HandleFunc("/signout-all", s.signOutAll).Methods("PUT").Name("signout_all")
+	router.HandleFunc("/.well-known/jwks.json", s.jwks).Methods("GET")
+	router.HandleFunc("/admin/lockout", s.unlockAccount).Methods("DELETE").Name("admin_unlock")
+	router.HandleFunc("/admin/users", s.listUsers).Methods("GET").Name("admin_users_list")
+	router.HandleFunc("/admin/user", s.showUser).Methods("GET").Name("admin_user_show")
+	router.HandleFunc("/admin/user/status", s.setUserStatus).Methods("PUT").Name("admin_user_status")
+	router.HandleFunc("/admin/user/roles", s.assignRoles).Methods("PUT").Name("admin_user_roles")
+	router.HandleFunc("/admin/user/password-reset", s.forcePasswordReset).Methods("POST").Name("admin_user_password_reset")
+	router.HandleFunc("/admin/user/sessions", s.revokeUserSessions).Methods("DELETE").Name("admin_user_sessions_revoke")
+	router.HandleFunc("/admin/audit", s.listAuditEvents).Methods("GET").Name("admin_audit_list")
+	router.HandleFunc("/admin/oauth/clients", s.registerOAuthClient).Methods("POST").Name("admin_oauth_client_register")
+	router.HandleFunc("/oauth/token", s.oauthToken).Methods("POST").Name("oauth_token")
+	router.HandleFunc("/oauth/introspect", s.introspect).Methods("POST") // not audited, resource servers call it on every request
+	router.Use(s.auditMiddleware)
+	err = utils.ListenAndServe(fmt.Sprintf(":%s", os.Getenv("INTERNAL_LISTEN_PORT")), router, 10*time.Second)
+	if err != nil {
+		log.Printf("Server stopped: %s\n", err.Error())
+	}
+	s.audit.close()
+	if store != nil {
+		err = store.Disconnect(10 * time.Second)
+		if err != nil {
+			log.Fatalf("Can't disconnect from database: %s", err.Error())
+		}
+	}
+	if boltStore != nil {
+		err = boltStore.Close()
+		if err != nil {
+			log.Fatalf("Can't close embedded storage: %s", err.Error())
+		}
+	}
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DenisAltruist/distsys/db"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var testSigningKey *signingKey
+
+// newTestServer keeps everything in memory and signs tokens with a generated key
+func newTestServer(t *testing.T) *server {
+	if testSigningKey == nil {
+		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("Can't generate signing key: %s", err.Error())
+		}
+		testSigningKey = &signingKey{id: "test", privateKey: privateKey, publicKey: &privateKey.PublicKey}
+	}
+	keys = &keyRing{signingKey: testSigningKey, keys: map[string]*signingKey{testSigningKey.id: testSigningKey}}
+	t.Setenv("ACCESS_TOKENS_DURATION_MINUTES", "5")
+	t.Setenv("REFRESH_TOKENS_DURATION_MINUTES", "60")
+	return newServer(db.NewMemoryAuthRepositories(&db.AuthRetention{}))
+}
+
+func addTestUser(t *testing.T, s *server, email string, roles ...string) *db.ShopUser {
+	user := &db.ShopUser{Email: email, Roles: roles, Status: db.UserStatusActive}
+	if err := s.users.AddNewUser(context.Background(), user); err != nil {
+		t.Fatalf("Can't add user %s: %s", email, err.Error())
+	}
+	return user
+}
+
+func newTestRequest() *http.Request {
+	return httptest.NewRequest(http.MethodPut, "/refresh", nil)
+}
+
+func checkAccessTokenRevoked(t *testing.T, s *server, tokens *db.TokensPair, want bool) {
+	claims, err := validateToken(tokens.AccessToken, "access", 0)
+	if err != nil {
+		t.Fatalf("Can't validate access token: %s", err.Error())
+	}
+	isRevoked, err := s.isTokenRevoked(context.Background(), claims)
+	if err != nil || isRevoked != want {
+		t.Errorf("Access token revoked: %t with error %v, want %t", isRevoked, err, want)
+	}
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	s := newTestServer(t)
+	user := addTestUser(t, s, "alice@example.com", db.RoleViewer)
+	first, err := s.issueTokens(user, "", nil, newTestRequest())
+	if err != nil {
+		t.Fatalf("Can't issue tokens: %s", err.Error())
+	}
+	second, err := s.rotateRefreshToken(first.RefreshToken, nil, newTestRequest())
+	if err != nil {
+		t.Fatalf("Can't refresh tokens: %s", err.Error())
+	}
+	other, err := s.issueTokens(user, "", nil, newTestRequest())
+	if err != nil {
+		t.Fatalf("Can't issue tokens of another session: %s", err.Error())
+	}
+	checkAccessTokenRevoked(t, s, second, false)
+
+	// the first token is presented again, e.g. by an attacker who stole it
+	_, err = s.rotateRefreshToken(first.RefreshToken, nil, newTestRequest())
+	if credErr, ok := err.(*credentialsError); !ok || credErr.code != http.StatusUnauthorized {
+		t.Fatalf("Got error %v on reuse, want 401", err)
+	}
+	tests := []struct {
+		name        string
+		tokens      *db.TokensPair
+		wantRevoked bool
+	}{
+		{name: "rotated token of the family", tokens: second, wantRevoked: true},
+		{name: "another session", tokens: other},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkAccessTokenRevoked(t, s, tt.tokens, tt.wantRevoked)
+			_, err := s.rotateRefreshToken(tt.tokens.RefreshToken, nil, newTestRequest())
+			if (err != nil) != tt.wantRevoked {
+				t.Errorf("Got error %v on refresh, want error: %t", err, tt.wantRevoked)
+			}
+		})
+	}
+	filter := bson.D{bson.E{Key: "email", Value: user.Email}, bson.E{Key: "revoked", Value: false}}
+	sessions, err := s.sessions.FindSessions(context.Background(), &filter)
+	if err != nil || len(sessions) != 1 {
+		t.Errorf("Got %d not revoked sessions with error %v, want only another one", len(sessions), err)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DenisAltruist/distsys/db"
+	"github.com/DenisAltruist/distsys/utils"
+	jwt "github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	grantPassword          = "password"
+	grantRefreshToken      = "refresh_token"
+	grantClientCredentials = "client_credentials"
+)
+
+var supportedGrantTypes = []string{grantPassword, grantRefreshToken, grantClientCredentials}
+
+// oauthError is error response of RFC 6749, section 5.2
+type oauthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+type oauthClientRequest struct {
+	Name          string   `json:"name"`
+	GrantTypes    []string `json:"grant_types"`
+	Roles         []string `json:"roles"`
+	CanIntrospect bool     `json:"can_introspect"`
+}
+
+type registeredOAuthClient struct {
+	*db.OAuthClient
+	Secret string `json:"client_secret"`
+}
+
+func setNoStoreHeaders(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+}
+
+func sendOAuthError(w http.ResponseWriter, code int, errorCode string, description string) {
+	setNoStoreHeaders(w)
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	utils.SendJSON(w, &oauthError{Error: errorCode, Description: description}, code)
+}
+
+// sendOAuthGrantError maps errors of checking user credentials to OAuth2 errors
+func sendOAuthGrantError(w http.ResponseWriter, err error) {
+	credErr, ok := err.(*credentialsError)
+	if !ok {
+		sendOAuthError(w, db.ErrorStatus(err), "server_error", err.Error())
+		return
+	}
+	if credErr.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(credErr.retryAfter.Seconds()))))
+	}
+	errorCode := credErr.oauthError
+	if len(errorCode) == 0 {
+		errorCode = "invalid_grant"
+	}
+	sendOAuthError(w, http.StatusBadRequest, errorCode, credErr.message)
+}
+
+// oauthGrant is what user tokens are issued for through the token endpoint
+type oauthGrant struct {
+	clientID string
+	// clientRoles are roles of the client, they limit roles of the user if no scope is requested
+	clientRoles []string
+	// scope limits roles of the user, nil means roles of the client
+	scope []string
+}
+
+func (g *oauthGrant) getClientID() string {
+	if g == nil {
+		return ""
+	}
+	return g.clientID
+}
+
+func (g *oauthGrant) getScope() []string {
+	if g == nil {
+		return nil
+	}
+	return g.scope
+}
+
+func (g *oauthGrant) roles(user *db.ShopUser) []string {
+	scope := g.scope
+	if scope == nil {
+		scope = g.clientRoles
+	}
+	roles := []string{}
+	for _, role := range user.Roles {
+		if containsString(scope, role) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+func containsAll(values []string, subset []string) bool {
+	for _, value := range subset {
+		if !containsString(values, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// getRequestedScope reads space-delimited scope of RFC 6749, section 3.3, nil
+// is returned if it's omitted
+func getRequestedScope(r *http.Request) []string {
+	scope := strings.Fields(r.PostFormValue("scope"))
+	if len(scope) == 0 {
+		return nil
+	}
+	return scope
+}
+
+// getClientCredentials reads client_id and client_secret either from HTTP Basic
+// authentication or from the request body
+func getClientCredentials(r *http.Request) (string, string, error) {
+	if clientID, clientSecret, ok := r.BasicAuth(); ok {
+		// RFC 6749 requires client credentials to be form-urlencoded before Basic encoding
+		clientID, err := url.QueryUnescape(clientID)
+		if err != nil {
+			return "", "", err
+		}
+		clientSecret, err = url.QueryUnescape(clientSecret)
+		if err != nil {
+			return "", "", err
+		}
+		return clientID, clientSecret, nil
+	}
+	return r.PostFormValue("client_id"), r.PostFormValue("client_secret"), nil
+}
+
+func (s *server) authenticateOAuthClient(r *http.Request) (*db.OAuthClient, error) {
+	clientID, clientSecret, err := getClientCredentials(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(clientID) == 0 {
+		return nil, nil
+	}
+	filter := bson.D{bson.E{Key: "client_id", Value: clientID}}
+	oauthClient, err := s.clients.FindOAuthClient(r.Context(), &filter)
+	if err != nil || oauthClient == nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(oauthClient.SecretHash), []byte(hashSecret(clientSecret))) != 1 {
+		return nil, nil
+	}
+	return oauthClient, nil
+}
+
+// issueClientToken issues access token to the client itself, no refresh token
+// is issued since the client can always authenticate again
+func issueClientToken(oauthClient *db.OAuthClient, scope []string) (*db.TokensPair, error) {
+	roles := oauthClient.Roles
+	if scope != nil {
+		roles = scope
+	}
+	accessTokenDur, err := strconv.Atoi(os.Getenv("ACCESS_TOKENS_DURATION_MINUTES"))
+	if err != nil {
+		return nil, err
+	}
+	accessTokenID, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	at, err := signToken(jwt.MapClaims{
+		"sub":       "client:" + oauthClient.ID,
+		"client_id": oauthClient.ID,
+		"type":      "access",
+		"roles":     roles,
+		"jti":       accessTokenID,
+		"iat":       time.Now().Unix(),
+		"exp":       time.Now().Add(time.Minute * time.Duration(accessTokenDur)).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &db.TokensPair{
+		AccessToken: at,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(accessTokenDur) * 60,
+		Scope:       strings.Join(roles, " "),
+	}, nil
+}
+
+// oauthToken is token endpoint of RFC 6749 supporting password, refresh_token
+// and client_credentials grants
+func (s *server) oauthToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		sendOAuthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	oauthClient, err := s.authenticateOAuthClient(r)
+	if err != nil {
+		sendOAuthError(w, db.ErrorStatus(err), "server_error", err.Error())
+		return
+	}
+	if oauthClient == nil {
+		sendOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+	setAuditEmail(r, "client:"+oauthClient.ID)
+	grantType := r.PostFormValue("grant_type")
+	if !containsString(supportedGrantTypes, grantType) {
+		sendOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", fmt.Sprintf("Grant type '%s' is not supported", grantType))
+		return
+	}
+	if !containsString(oauthClient.GrantTypes, grantType) {
+		sendOAuthError(w, http.StatusBadRequest, "unauthorized_client", fmt.Sprintf("Client is not allowed to use '%s' grant", grantType))
+		return
+	}
+	// roles of the client are the scopes it may request
+	scope := getRequestedScope(r)
+	if !containsAll(oauthClient.Roles, scope) {
+		sendOAuthError(w, http.StatusBadRequest, "invalid_scope", fmt.Sprintf("Client is not allowed to request scope '%s'", r.PostFormValue("scope")))
+		return
+	}
+	grant := &oauthGrant{clientID: oauthClient.ID, clientRoles: oauthClient.Roles, scope: scope}
+	var tokens *db.TokensPair
+	switch grantType {
+	case grantPassword:
+		username := canonicalEmail(r.PostFormValue("username"))
+		setAuditEmail(r, username)
+		user, err := s.checkCredentials(r.Context(), username, r.PostFormValue("password"), getClientIP(r))
+		if err != nil {
+			sendOAuthGrantError(w, err)
+			return
+		}
+		if user.TOTPEnabled {
+			sendOAuthError(w, http.StatusBadRequest, "invalid_grant", "Two-factor authentication is required, use /signin instead")
+			return
+		}
+		tokens, err = s.issueTokens(user, "", grant, r)
+		if err != nil {
+			sendOAuthError(w, db.ErrorStatus(err), "server_error", err.Error())
+			return
+		}
+	case grantRefreshToken:
+		tokens, err = s.rotateRefreshToken(r.PostFormValue("refresh_token"), grant, r)
+		if err != nil {
+			sendOAuthGrantError(w, err)
+			return
+		}
+	case grantClientCredentials:
+		tokens, err = issueClientToken(oauthClient, scope)
+		if err != nil {
+			sendOAuthError(w, db.ErrorStatus(err), "server_error", err.Error())
+			return
+		}
+	}
+	setNoStoreHeaders(w)
+	utils.SendJSON(w, tokens, http.StatusOK)
+}
+
+func (s *server) registerOAuthClient(w http.ResponseWriter, r *http.Request) {
+	if s.authorizeRequest(w, r, db.RoleAdmin) == nil {
+		return
+	}
+	var req oauthClientRequest
+	if !utils.ReadJSON(w, r, &req) {
+		return
+	}
+	for _, grantType := range req.GrantTypes {
+		if !containsString(supportedGrantTypes, grantType) {
+			utils.SendError(w, http.StatusBadRequest, "Grant type %s is not supported", grantType)
+			return
+		}
+	}
+	for _, role := range req.Roles {
+		if !containsString(knownRoles, role) {
+			utils.SendError(w, http.StatusBadRequest, "Role %s is not known", role)
+			return
+		}
+	}
+	clientID, err := randomHex(8)
+	if err != nil {
+		utils.SendError(w, http.StatusInternalServerError, "Can't generate client id, got an error: %s", err.Error())
+		return
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		utils.SendError(w, http.StatusInternalServerError, "Can't generate client secret, got an error: %s", err.Error())
+		return
+	}
+	oauthClient := db.OAuthClient{
+		ID:            clientID,
+		Name:          req.Name,
+		SecretHash:    hashSecret(secret),
+		GrantTypes:    req.GrantTypes,
+		Roles:         req.Roles,
+		CanIntrospect: req.CanIntrospect,
+		CreatedAt:     time.Now(),
+	}
+	err = s.clients.AddOAuthClient(r.Context(), &oauthClient)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't register client, got an error: %s", err.Error())
+		return
+	}
+	// The secret is shown only once
+	utils.SendJSON(w, &registeredOAuthClient{OAuthClient: &oauthClient, Secret: secret}, http.StatusCreated)
+}
+
+// bootstrapIntrospectionClient registers resource server configured by environment,
+// so that services deployed together can introspect tokens without manual setup.
+// Secret of the client registered before is replaced when the environment changes
+func (s *server) bootstrapIntrospectionClient(ctx context.Context) error {
+	clientID := os.Getenv("BOOTSTRAP_INTROSPECTION_CLIENT_ID")
+	if len(clientID) == 0 {
+		return nil
+	}
+	secret := os.Getenv("BOOTSTRAP_INTROSPECTION_CLIENT_SECRET")
+	if len(secret) == 0 {
+		return fmt.Errorf("BOOTSTRAP_INTROSPECTION_CLIENT_SECRET is not set for client %s", clientID)
+	}
+	secretHash := hashSecret(secret)
+	filter := bson.D{bson.E{Key: "client_id", Value: clientID}}
+	oauthClient, err := s.clients.FindOAuthClient(ctx, &filter)
+	if err != nil {
+		return err
+	}
+	if oauthClient != nil {
+		if oauthClient.SecretHash == secretHash && oauthClient.CanIntrospect {
+			return nil
+		}
+		update := bson.D{bson.E{Key: "$set", Value: bson.D{
+			bson.E{Key: "secret_hash", Value: secretHash},
+			bson.E{Key: "can_introspect", Value: true},
+		}}}
+		_, err = s.clients.UpdateOAuthClient(ctx, &filter, &update)
+		if err != nil {
+			return err
+		}
+		log.Printf("Updated secret of introspection client %s\n", clientID)
+		return nil
+	}
+	return s.clients.AddOAuthClient(ctx, &db.OAuthClient{
+		ID:            clientID,
+		Name:          clientID,
+		SecretHash:    secretHash,
+		GrantTypes:    []string{},
+		Roles:         []string{},
+		CanIntrospect: true,
+		CreatedAt:     time.Now(),
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/DenisAltruist/distsys/db"
+)
+
+func TestOAuthGrantRoles(t *testing.T) {
+	user := &db.ShopUser{Email: "alice@example.com", Roles: []string{db.RoleAdmin, db.RoleViewer}}
+	tests := []struct {
+		name  string
+		grant oauthGrant
+		want  []string
+	}{
+		{name: "no scope, roles of the client", grant: oauthGrant{clientRoles: []string{db.RoleViewer, db.RoleEditor}}, want: []string{db.RoleViewer}},
+		{name: "no scope, client without roles", grant: oauthGrant{}, want: []string{}},
+		{name: "scope", grant: oauthGrant{clientRoles: []string{db.RoleAdmin, db.RoleViewer}, scope: []string{db.RoleViewer}}, want: []string{db.RoleViewer}},
+		{name: "scope beyond user roles", grant: oauthGrant{clientRoles: []string{db.RoleEditor}, scope: []string{db.RoleEditor}}, want: []string{}},
+		{name: "empty scope", grant: oauthGrant{clientRoles: []string{db.RoleViewer}, scope: []string{}}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.grant.roles(user)
+			if len(got) != len(tt.want) || !containsAll(got, tt.want) {
+				t.Errorf("roles = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefreshTokenBoundToClient(t *testing.T) {
+	reporting := &oauthGrant{clientID: "reporting", clientRoles: []string{db.RoleAdmin, db.RoleViewer}, scope: []string{db.RoleViewer}}
+	tests := []struct {
+		name      string
+		issue     *oauthGrant
+		refresh   *oauthGrant
+		wantErr   bool
+		wantRoles string
+	}{
+		{name: "same client", issue: reporting, refresh: &oauthGrant{clientID: "reporting", clientRoles: reporting.clientRoles}, wantRoles: db.RoleViewer},
+		{name: "narrower scope", issue: &oauthGrant{clientID: "reporting", clientRoles: reporting.clientRoles}, refresh: reporting, wantRoles: db.RoleViewer},
+		{name: "wider scope", issue: reporting, refresh: &oauthGrant{clientID: "reporting", clientRoles: reporting.clientRoles, scope: []string{db.RoleAdmin}}, wantErr: true},
+		{name: "another client", issue: reporting, refresh: &oauthGrant{clientID: "mobile", clientRoles: reporting.clientRoles}, wantErr: true},
+		{name: "client token by /refresh", issue: reporting, wantErr: true},
+		{name: "user token by client", refresh: &oauthGrant{clientID: "reporting", clientRoles: reporting.clientRoles}, wantErr: true},
+		{name: "user token by /refresh", wantRoles: db.RoleAdmin + " " + db.RoleViewer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			user := addTestUser(t, s, "alice@example.com", db.RoleAdmin, db.RoleViewer)
+			tokens, err := s.issueTokens(user, "", tt.issue, newTestRequest())
+			if err != nil {
+				t.Fatalf("Can't issue tokens: %s", err.Error())
+			}
+			refreshed, err := s.rotateRefreshToken(tokens.RefreshToken, tt.refresh, newTestRequest())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Got error %v, want error: %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && refreshed.Scope != tt.wantRoles {
+				t.Errorf("Scope = %q, want %q", refreshed.Scope, tt.wantRoles)
+			}
+		})
+	}
+}
+
+func TestOAuthPasswordGrantDefaultScope(t *testing.T) {
+	s := newTestServer(t)
+	passwordHash, err := calcPassHash("correct horse")
+	if err != nil {
+		t.Fatalf("Can't hash password: %s", err.Error())
+	}
+	user := &db.ShopUser{Email: "alice@example.com", PasswordHash: passwordHash, Roles: []string{db.RoleAdmin, db.RoleViewer}, Status: db.UserStatusActive}
+	if err := s.users.AddNewUser(context.Background(), user); err != nil {
+		t.Fatalf("Can't add user: %s", err.Error())
+	}
+	oauthClient := &db.OAuthClient{ID: "reporting", SecretHash: hashSecret("secret"), GrantTypes: []string{grantPassword}, Roles: []string{db.RoleViewer, db.RoleEditor}}
+	if err := s.clients.AddOAuthClient(context.Background(), oauthClient); err != nil {
+		t.Fatalf("Can't add client: %s", err.Error())
+	}
+	form := url.Values{
+		"grant_type":    {grantPassword},
+		"client_id":     {"reporting"},
+		"client_secret": {"secret"},
+		"username":      {"alice@example.com"},
+		"password":      {"correct horse"},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	s.oauthToken(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var tokens db.TokensPair
+	if err := json.Unmarshal(w.Body.Bytes(), &tokens); err != nil {
+		t.Fatalf("Can't decode tokens: %s", err.Error())
+	}
+	if tokens.Scope != db.RoleViewer {
+		t.Errorf("Scope = %q, want roles of both the client and the user", tokens.Scope)
+	}
+}
+
+func TestRegisterOAuthClientRoles(t *testing.T) {
+	tests := []struct {
+		name       string
+		roles      []string
+		wantStatus int
+	}{
+		{name: "known roles", roles: []string{db.RoleViewer, db.RoleEditor}, wantStatus: http.StatusCreated},
+		{name: "no roles", wantStatus: http.StatusCreated},
+		{name: "unknown role", roles: []string{db.RoleViewer, "root"}, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			admin := addTestUser(t, s, "admin@example.com", db.RoleAdmin)
+			tokens, err := s.issueTokens(admin, "", nil, newTestRequest())
+			if err != nil {
+				t.Fatalf("Can't issue tokens: %s", err.Error())
+			}
+			body, _ := json.Marshal(&oauthClientRequest{Name: "reporting", GrantTypes: []string{grantClientCredentials}, Roles: tt.roles})
+			r := httptest.NewRequest(http.MethodPost, "/admin/oauth/clients", bytes.NewReader(body))
+			r.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+			w := httptest.NewRecorder()
+			s.registerOAuthClient(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("Status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/DenisAltruist/distsys/db"
+	"github.com/DenisAltruist/distsys/utils"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type passwordResetRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// sendPasswordResetEmail stores reset token of the user matching the filter and
+// mails it. If required, the user can't sign in until password is reset.
+func (s *server) sendPasswordResetEmail(ctx context.Context, filter *bson.D, required bool) (bool, error) {
+	tokenDur, err := strconv.Atoi(os.Getenv("PASSWORD_RESET_TOKEN_DURATION_MINUTES"))
+	if err != nil {
+		return false, err
+	}
+	token, err := randomHex(32)
+	if err != nil {
+		return false, err
+	}
+	set := bson.D{
+		bson.E{Key: "password_reset_hash", Value: hashSecret(token)},
+		bson.E{Key: "password_reset_expires_at", Value: time.Now().Add(time.Minute * time.Duration(tokenDur))},
+	}
+	if required {
+		set = append(set, bson.E{Key: "password_reset_required", Value: true})
+	}
+	update := bson.D{bson.E{Key: "$set", Value: set}}
+	matched, err := s.users.UpdateUser(ctx, filter, &update)
+	if err != nil || matched == 0 {
+		return false, err
+	}
+	user, err := s.users.FindUserBy(ctx, filter)
+	if err != nil || user == nil {
+		return false, err
+	}
+	link := fmt.Sprintf("%s?token=%s", os.Getenv("PASSWORD_RESET_URL"), url.QueryEscape(token))
+	body := fmt.Sprintf("To set a new password use the token below or follow the link:\n\n%s\n\n%s\n\nThe token expires in %d minutes. "+
+		"If you didn't ask to reset the password, ignore this email.\n", token, link, tokenDur)
+	if required {
+		body = fmt.Sprintf("Administrator requires you to set a new password. Use the token below or follow the link:\n\n%s\n\n%s\n\n"+
+			"The token expires in %d minutes, request a new one with forgot password form after that.\n", token, link, tokenDur)
+	}
+	return true, mailer.Send(user.Email, "Password reset", body)
+}
+
+func (s *server) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	user, ok := getShopUserFromReq(w, r)
+	if !ok {
+		return
+	}
+	filter := bson.D{
+		bson.E{Key: "email", Value: user.Email},
+		bson.E{Key: "status", Value: bson.D{bson.E{Key: "$nin", Value: []string{db.UserStatusPending, db.UserStatusDisabled}}}},
+	}
+	_, err := s.sendPasswordResetEmail(r.Context(), &filter, false)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't send reset email, got an error: %s", err.Error())
+		return
+	}
+	// The same response for any email not to disclose which ones are registered
+	utils.SendBodyResponse(w, "Reset instructions are sent if the account exists", http.StatusOK)
+}
+
+func (s *server) resetPassword(w http.ResponseWriter, r *http.Request) {
+	var req passwordResetRequest
+	if !utils.ReadJSON(w, r, &req) {
+		return
+	}
+	tokenHash := hashSecret(req.Token)
+	filter := bson.D{
+		bson.E{Key: "password_reset_hash", Value: tokenHash},
+		bson.E{Key: "password_reset_expires_at", Value: bson.D{bson.E{Key: "$gt", Value: time.Now()}}},
+	}
+	user, err := s.users.FindUserBy(r.Context(), &filter)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Got an error on find user: %s", err.Error())
+		return
+	}
+	if user == nil {
+		utils.SendError(w, http.StatusBadRequest, "Reset token is expired or not correct")
+		return
+	}
+	setAuditEmail(r, user.Email)
+	if sendFieldErrors(w, passwordRules.check("password", req.Password, user.Email)) {
+		return
+	}
+	passwordHash, err := calcPassHash(req.Password)
+	if err != nil {
+		utils.SendError(w, http.StatusInternalServerError, "Can't calculate password hash, got an error: %s", err.Error())
+		return
+	}
+	// Matching by token hash once again makes the token single-use under concurrent requests
+	filter = bson.D{
+		bson.E{Key: "email", Value: user.Email},
+		bson.E{Key: "password_reset_hash", Value: tokenHash},
+	}
+	update := bson.D{
+		bson.E{Key: "$set", Value: bson.D{bson.E{Key: "password_hash", Value: passwordHash}}},
+		bson.E{Key: "$unset", Value: bson.D{
+			bson.E{Key: "password_reset_hash", Value: ""},
+			bson.E{Key: "password_reset_expires_at", Value: ""},
+			bson.E{Key: "password_reset_required", Value: ""},
+		}},
+	}
+	matched, err := s.users.UpdateUser(r.Context(), &filter, &update)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't update password, got an error: %s", err.Error())
+		return
+	}
+	if matched == 0 {
+		utils.SendError(w, http.StatusBadRequest, "Reset token has already been used")
+		return
+	}
+	sessionsFilter := bson.D{bson.E{Key: "email", Value: user.Email}}
+	// reset token is spent, the client can't retry once the password is changed
+	err = s.revokeSessions(context.Background(), &sessionsFilter)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Password is changed, but can't revoke sessions, got an error: %s", err.Error())
+		return
+	}
+	utils.SendBodyResponse(w, "Password is changed", http.StatusOK)
+}
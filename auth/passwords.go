@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	argon2Time    = 1
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+
+	argon2Prefix = "$argon2id$"
+)
+
+type argon2Params struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+}
+
+var currentArgon2Params = argon2Params{
+	time:    argon2Time,
+	memory:  argon2Memory,
+	threads: argon2Threads,
+}
+
+// dummyPassHash is compared with the password when there is no such user, so
+// that response time doesn't tell whether the email is registered
+var dummyPassHash = fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+	argon2Prefix, argon2.Version, argon2Memory, argon2Time, argon2Threads,
+	base64.RawStdEncoding.EncodeToString(make([]byte, argon2SaltLen)),
+	base64.RawStdEncoding.EncodeToString(make([]byte, argon2KeyLen)),
+)
+
+// calcPassHash returns password hash in PHC string format:
+// $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>
+func calcPassHash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	p := currentArgon2Params
+	hash := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, argon2KeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2Prefix, argon2.Version, p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash),
+	), nil
+}
+
+// calcLegacyPassHash is the unsalted MD5 digest stored by old versions of the service
+func calcLegacyPassHash(password string) string {
+	bytes := md5.Sum([]byte(password))
+	return string(bytes[:])
+}
+
+func decodeArgon2Hash(encoded string) (*argon2Params, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, errors.New("Unknown password hash format")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, nil, nil, err
+	}
+	if version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("Unsupported argon2 version: %d", version)
+	}
+	var p argon2Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return nil, nil, nil, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return &p, salt, hash, nil
+}
+
+// comparePass checks password against stored hash. needsRehash is true when the hash
+// is in legacy format or was calculated with outdated parameters.
+func comparePass(password string, hash string) (ok bool, needsRehash bool) {
+	if !strings.HasPrefix(hash, argon2Prefix) {
+		legacyHash := calcLegacyPassHash(password)
+		ok = subtle.ConstantTimeCompare([]byte(legacyHash), []byte(hash)) == 1
+		return ok, ok
+	}
+	p, salt, storedHash, err := decodeArgon2Hash(hash)
+	if err != nil {
+		return false, false
+	}
+	gotHash := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, uint32(len(storedHash)))
+	ok = subtle.ConstantTimeCompare(gotHash, storedHash) == 1
+	return ok, ok && (*p != currentArgon2Params || len(storedHash) != argon2KeyLen)
+}
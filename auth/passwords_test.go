@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// outdatedPassHash is argon2id hash with parameters other than current ones
+func outdatedPassHash(password string) string {
+	salt := []byte("0123456789abcdef")
+	hash := argon2.IDKey([]byte(password), salt, argon2Time+1, argon2Memory/2, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2Prefix, argon2.Version, argon2Memory/2, argon2Time+1, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash),
+	)
+}
+
+func TestComparePass(t *testing.T) {
+	currentHash, err := calcPassHash("correct horse")
+	if err != nil {
+		t.Fatalf("Can't hash password: %s", err.Error())
+	}
+	tests := []struct {
+		name            string
+		password        string
+		hash            string
+		wantOK          bool
+		wantNeedsRehash bool
+	}{
+		{name: "current hash", password: "correct horse", hash: currentHash, wantOK: true},
+		{name: "current hash, wrong password", password: "battery staple", hash: currentHash},
+		{name: "outdated parameters", password: "correct horse", hash: outdatedPassHash("correct horse"), wantOK: true, wantNeedsRehash: true},
+		{name: "outdated parameters, wrong password", password: "battery staple", hash: outdatedPassHash("correct horse")},
+		{name: "legacy hash", password: "correct horse", hash: calcLegacyPassHash("correct horse"), wantOK: true, wantNeedsRehash: true},
+		{name: "legacy hash, wrong password", password: "battery staple", hash: calcLegacyPassHash("correct horse")},
+		{name: "malformed hash", password: "correct horse", hash: argon2Prefix + "v=19$broken"},
+		{name: "unsupported version", password: "correct horse", hash: argon2Prefix + "v=16$m=65536,t=1,p=4$c2FsdA$aGFzaA"},
+		{name: "empty hash", password: "", hash: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, needsRehash := comparePass(tt.password, tt.hash)
+			if ok != tt.wantOK || needsRehash != tt.wantNeedsRehash {
+				t.Errorf("comparePass = (%t, %t), want (%t, %t)", ok, needsRehash, tt.wantOK, tt.wantNeedsRehash)
+			}
+		})
+	}
+}
+
+// TestDummyPassHash checks that unknown users cost the same argon2 computation as known ones
+func TestDummyPassHash(t *testing.T) {
+	p, salt, hash, err := decodeArgon2Hash(dummyPassHash)
+	if err != nil {
+		t.Fatalf("Dummy hash is malformed: %s", err.Error())
+	}
+	if *p != currentArgon2Params || len(salt) != argon2SaltLen || len(hash) != argon2KeyLen {
+		t.Errorf("Dummy hash has parameters %+v, salt of %d bytes and hash of %d bytes, want current ones", *p, len(salt), len(hash))
+	}
+	if ok, _ := comparePass("", dummyPassHash); ok {
+		t.Errorf("Dummy hash matches empty password")
+	}
+}
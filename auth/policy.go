@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/DenisAltruist/distsys/db"
+	"github.com/DenisAltruist/distsys/utils"
+)
+
+// Longer passwords are refused not to spend too much time on hashing them
+const maxPasswordLength = 1024
+
+type characterClass struct {
+	name  string
+	check func(rune) bool
+}
+
+var characterClasses = []characterClass{
+	{"lower", unicode.IsLower},
+	{"upper", unicode.IsUpper},
+	{"digit", unicode.IsDigit},
+	{"symbol", func(c rune) bool { return unicode.IsPunct(c) || unicode.IsSymbol(c) || unicode.IsSpace(c) }},
+}
+
+// passwordPolicy is configured by PASSWORD_* variables, denylist contains
+// common and breached passwords in lower case
+type passwordPolicy struct {
+	minLength       int
+	requiredClasses []characterClass
+	denylist        map[string]bool
+}
+
+var passwordRules passwordPolicy
+
+// fieldError is a single violated rule of the request field
+type fieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+type fieldErrorsResponse struct {
+	utils.ClientResponse
+	Errors []fieldError `json:"errors"`
+}
+
+func loadDenylist(path string) (map[string]bool, error) {
+	denylist := make(map[string]bool)
+	if len(path) == 0 {
+		return denylist, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		denylist[strings.ToLower(line)] = true
+	}
+	return denylist, scanner.Err()
+}
+
+func initPasswordPolicy() error {
+	minLength, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH"))
+	if err != nil {
+		return fmt.Errorf("Can't parse PASSWORD_MIN_LENGTH: %s", err.Error())
+	}
+	var requiredClasses []characterClass
+	for _, name := range strings.Split(os.Getenv("PASSWORD_REQUIRED_CLASSES"), ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		found := false
+		for _, class := range characterClasses {
+			if class.name == name {
+				requiredClasses = append(requiredClasses, class)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Unknown character class in PASSWORD_REQUIRED_CLASSES: %s", name)
+		}
+	}
+	denylist, err := loadDenylist(os.Getenv("PASSWORD_DENYLIST_FILE"))
+	if err != nil {
+		return fmt.Errorf("Can't load PASSWORD_DENYLIST_FILE: %s", err.Error())
+	}
+	passwordRules = passwordPolicy{minLength: minLength, requiredClasses: requiredClasses, denylist: denylist}
+	return nil
+}
+
+// check returns every rule the password violates, email is used to refuse
+// passwords equal to it
+func (p *passwordPolicy) check(field string, password string, email string) []fieldError {
+	var errs []fieldError
+	length := len([]rune(password))
+	if length < p.minLength {
+		errs = append(errs, fieldError{field, "min_length", fmt.Sprintf("Password must be at least %d characters long", p.minLength)})
+	}
+	if length > maxPasswordLength {
+		errs = append(errs, fieldError{field, "max_length", fmt.Sprintf("Password must be at most %d characters long", maxPasswordLength)})
+	}
+	for _, class := range p.requiredClasses {
+		if strings.IndexFunc(password, class.check) == -1 {
+			errs = append(errs, fieldError{field, "character_class", fmt.Sprintf("Password must contain at least one %s character", class.name)})
+		}
+	}
+	lowered := strings.ToLower(password)
+	if p.denylist[lowered] {
+		errs = append(errs, fieldError{field, "denylist", "Password is too common"})
+	}
+	if len(email) != 0 && lowered == strings.ToLower(email) {
+		errs = append(errs, fieldError{field, "not_email", "Password must differ from email"})
+	}
+	return errs
+}
+
+// canonicalEmail is the form of emails users are stored and looked up by
+func canonicalEmail(email string) string {
+	return db.CanonicalEmail(email)
+}
+
+// checkEmail validates email as RFC 5322 address without display name and
+// returns its canonical form
+func checkEmail(field string, email string) (string, []fieldError) {
+	email = canonicalEmail(email)
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return email, []fieldError{{field, "format", "Email is not a valid address"}}
+	}
+	at := strings.LastIndex(email, "@")
+	var errs []fieldError
+	// RFC 5321 limits
+	if at > 64 {
+		errs = append(errs, fieldError{field, "local_part_length", "Local part of email must be at most 64 characters long"})
+	}
+	if len(email) > 254 {
+		errs = append(errs, fieldError{field, "max_length", "Email must be at most 254 characters long"})
+	}
+	if !strings.Contains(email[at+1:], ".") {
+		errs = append(errs, fieldError{field, "domain", "Email domain must be fully qualified"})
+	}
+	return email, errs
+}
+
+// sendFieldErrors responds with every violated rule, returns false if there are none
+func sendFieldErrors(w http.ResponseWriter, errs []fieldError) bool {
+	if len(errs) == 0 {
+		return false
+	}
+	utils.SendJSON(w, &fieldErrorsResponse{
+		ClientResponse: utils.ClientResponse{Text: "Request violates policy", Code: http.StatusBadRequest},
+		Errors:         errs,
+	}, http.StatusBadRequest)
+	return true
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func fieldRules(errs []fieldError) []string {
+	rules := []string{}
+	for _, err := range errs {
+		rules = append(rules, err.Rule)
+	}
+	return rules
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy := &passwordPolicy{
+		minLength:       8,
+		requiredClasses: []characterClass{characterClasses[0], characterClasses[2]},
+		denylist:        map[string]bool{"password1": true},
+	}
+	tests := []struct {
+		name      string
+		password  string
+		email     string
+		wantRules []string
+	}{
+		{name: "valid", password: "correct horse 1", wantRules: []string{}},
+		{name: "too short", password: "abc1", wantRules: []string{"min_length"}},
+		{name: "length in characters", password: "пароль12", wantRules: []string{}},
+		{name: "too long", password: strings.Repeat("a1", maxPasswordLength), wantRules: []string{"max_length"}},
+		{name: "missing classes", password: "CORRECT HORSE", wantRules: []string{"character_class", "character_class"}},
+		{name: "denylisted in another case", password: "PassWord1", wantRules: []string{"denylist"}},
+		{name: "equal to email", password: "Alice1@example.com", email: "alice1@example.com", wantRules: []string{"not_email"}},
+		{name: "every rule", password: "A", wantRules: []string{"min_length", "character_class", "character_class"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := policy.check("password", tt.password, tt.email)
+			got := fieldRules(errs)
+			if strings.Join(got, ",") != strings.Join(tt.wantRules, ",") {
+				t.Errorf("Violated rules = %v, want %v", got, tt.wantRules)
+			}
+			for _, err := range errs {
+				if err.Field != "password" || len(err.Message) == 0 {
+					t.Errorf("Field error = %+v, want field password with message", err)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckEmail(t *testing.T) {
+	tests := []struct {
+		name      string
+		email     string
+		wantEmail string
+		wantRules []string
+	}{
+		{name: "valid", email: "alice@example.com", wantEmail: "alice@example.com", wantRules: []string{}},
+		{name: "canonical form", email: "  Alice@Example.COM ", wantEmail: "alice@example.com", wantRules: []string{}},
+		{name: "not an address", email: "alice", wantEmail: "alice", wantRules: []string{"format"}},
+		{name: "display name", email: "Alice <alice@example.com>", wantEmail: "alice <alice@example.com>", wantRules: []string{"format"}},
+		{name: "long local part", email: strings.Repeat("a", 65) + "@example.com", wantEmail: strings.Repeat("a", 65) + "@example.com", wantRules: []string{"local_part_length"}},
+		{name: "too long", email: "alice@" + strings.Repeat("a", 250) + ".com", wantEmail: "alice@" + strings.Repeat("a", 250) + ".com", wantRules: []string{"max_length"}},
+		{name: "not fully qualified domain", email: "alice@localhost", wantEmail: "alice@localhost", wantRules: []string{"domain"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			email, errs := checkEmail("email", tt.email)
+			if email != tt.wantEmail {
+				t.Errorf("Email = %q, want %q", email, tt.wantEmail)
+			}
+			got := fieldRules(errs)
+			if strings.Join(got, ",") != strings.Join(tt.wantRules, ",") {
+				t.Errorf("Violated rules = %v, want %v", got, tt.wantRules)
+			}
+		})
+	}
+}
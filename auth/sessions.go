@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/DenisAltruist/distsys/db"
+	"github.com/DenisAltruist/distsys/utils"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// listSessions shows active sessions of the user, i.e. devices signed in
+func (s *server) listSessions(w http.ResponseWriter, r *http.Request) {
+	claims := s.authorizeRequest(w, r)
+	if claims == nil {
+		return
+	}
+	filter := bson.D{
+		bson.E{Key: "email", Value: (*claims)["email"]},
+		bson.E{Key: "revoked", Value: false},
+		bson.E{Key: "expires_at", Value: bson.D{bson.E{Key: "$gt", Value: time.Now()}}},
+	}
+	sessions, err := s.sessions.FindSessions(r.Context(), &filter)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't find sessions, got an error: %s", err.Error())
+		return
+	}
+	currentID, _ := (*claims)["sid"].(string)
+	for _, session := range sessions {
+		session.Current = session.ID == currentID
+	}
+	utils.SendJSON(w, sessions, http.StatusOK)
+}
+
+// revokeSession signs out the device of the session
+func (s *server) revokeSession(w http.ResponseWriter, r *http.Request) {
+	claims := s.authorizeRequest(w, r)
+	if claims == nil {
+		return
+	}
+	filterKey := "id"
+	filterVal := r.FormValue(filterKey)
+	if len(filterVal) == 0 {
+		utils.SendError(w, http.StatusBadRequest, "'%s' argument is not specified", filterKey)
+		return
+	}
+	filter := bson.D{
+		bson.E{Key: "session_id", Value: filterVal},
+		bson.E{Key: "email", Value: (*claims)["email"]},
+		bson.E{Key: "revoked", Value: false},
+	}
+	sessions, err := s.sessions.FindSessions(r.Context(), &filter)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't find session, got an error: %s", err.Error())
+		return
+	}
+	if len(sessions) == 0 {
+		utils.SendError(w, http.StatusBadRequest, "There is no session with id %s to revoke", filterVal)
+		return
+	}
+	familyFilter := bson.D{bson.E{Key: "family_id", Value: filterVal}}
+	// unlike revocation after a change of password, nothing is changed before,
+	// the session stays in the list until the request succeeds
+	err = s.revokeSessions(r.Context(), &familyFilter)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't revoke session, got an error: %s", err.Error())
+		return
+	}
+	utils.SendBodyResponse(w, "Success", http.StatusOK)
+}
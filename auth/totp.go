@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters of RFC 6238 supported by all authenticator apps
+const (
+	totpPeriod      = 30
+	totpDigits      = 6
+	totpModulo      = 1000000 // 10^totpDigits
+	totpSecretLen   = 20
+	totpSkewSteps   = 1 // accepted clock drift in periods
+	recoveryCodes   = 10
+	recoveryCodeLen = 5 // bytes in each half of a code
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretLen)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+func getTOTPURI(issuer string, email string, secret string) string {
+	label := url.PathEscape(issuer + ":" + email)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprintf("%d", totpDigits))
+	params.Set("period", fmt.Sprintf("%d", totpPeriod))
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, params.Encode())
+}
+
+func calcTOTP(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%totpModulo)
+}
+
+// verifyTOTP returns time step matched by code. Only steps after lastStep are
+// accepted, so that every code can be used once.
+func verifyTOTP(secret string, code string, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	curStep := time.Now().Unix() / totpPeriod
+	for step := curStep - totpSkewSteps; step <= curStep+totpSkewSteps; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(calcTOTP(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, 0, recoveryCodes)
+	for i := 0; i < recoveryCodes; i++ {
+		first, err := randomHex(recoveryCodeLen)
+		if err != nil {
+			return nil, err
+		}
+		second, err := randomHex(recoveryCodeLen)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, first+"-"+second)
+	}
+	return codes, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// RFC 6238 test key of SHA-1
+var totpTestKey = []byte("12345678901234567890")
+
+func TestCalcTOTP(t *testing.T) {
+	// RFC 6238 appendix B codes truncated to 6 digits
+	tests := []struct {
+		unixTime int64
+		want     string
+	}{
+		{unixTime: 59, want: "287082"},
+		{unixTime: 1111111109, want: "081804"},
+		{unixTime: 1111111111, want: "050471"},
+		{unixTime: 1234567890, want: "005924"},
+		{unixTime: 2000000000, want: "279037"},
+	}
+	for _, tt := range tests {
+		if got := calcTOTP(totpTestKey, tt.unixTime/totpPeriod); got != tt.want {
+			t.Errorf("Code at %d = %s, want %s", tt.unixTime, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString(totpTestKey)
+	curStep := time.Now().Unix() / totpPeriod
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		lastStep int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{name: "current step", secret: secret, code: calcTOTP(totpTestKey, curStep), wantStep: curStep, wantOK: true},
+		{name: "previous step", secret: secret, code: calcTOTP(totpTestKey, curStep-1), wantStep: curStep - 1, wantOK: true},
+		{name: "next step", secret: secret, code: calcTOTP(totpTestKey, curStep+1), wantStep: curStep + 1, wantOK: true},
+		{name: "out of window in the past", secret: secret, code: calcTOTP(totpTestKey, curStep-totpSkewSteps-1)},
+		{name: "out of window in the future", secret: secret, code: calcTOTP(totpTestKey, curStep+totpSkewSteps+1)},
+		{name: "used code", secret: secret, code: calcTOTP(totpTestKey, curStep), lastStep: curStep},
+		{name: "code before used one", secret: secret, code: calcTOTP(totpTestKey, curStep-1), lastStep: curStep},
+		{name: "code after used one", secret: secret, code: calcTOTP(totpTestKey, curStep+1), lastStep: curStep, wantStep: curStep + 1, wantOK: true},
+		{name: "lowercase secret", secret: "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", code: calcTOTP(totpTestKey, curStep), wantStep: curStep, wantOK: true},
+		{name: "wrong code", secret: secret, code: "abcdef"},
+		{name: "empty code", secret: secret, code: ""},
+		{name: "malformed secret", secret: "not base32!", code: calcTOTP(totpTestKey, curStep)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := verifyTOTP(tt.secret, tt.code, tt.lastStep)
+			if ok != tt.wantOK || step != tt.wantStep {
+				t.Errorf("verifyTOTP = (%d, %t), want (%d, %t)", step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
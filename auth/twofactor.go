@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/DenisAltruist/distsys/db"
+	"github.com/DenisAltruist/distsys/utils"
+	jwt "github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const twoFactorChallengeTokenType = "2fa_challenge"
+
+type twoFactorChallenge struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+}
+
+type twoFactorCodeRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+}
+
+type twoFactorEnrollment struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+type twoFactorDisableRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type twoFactorRecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// sendTwoFactorChallenge responds to sign in of user with enabled 2FA by
+// short-lived token, which is exchanged for tokens pair with a valid code
+func sendTwoFactorChallenge(w http.ResponseWriter, user *db.ShopUser) {
+	challengeDur, err := strconv.Atoi(os.Getenv("TWO_FACTOR_CHALLENGE_DURATION_MINUTES"))
+	if err != nil {
+		utils.SendError(w, http.StatusInternalServerError, "Can't parse challenge tokens duration from config: %s", err.Error())
+		return
+	}
+	tokenID, err := newTokenID()
+	if err != nil {
+		utils.SendError(w, http.StatusInternalServerError, "Can't generate token id, got an error: %s", err.Error())
+		return
+	}
+	challengeToken, err := signToken(jwt.MapClaims{
+		"email": user.Email,
+		"type":  twoFactorChallengeTokenType,
+		"jti":   tokenID,
+		"exp":   time.Now().Add(time.Minute * time.Duration(challengeDur)).Unix(),
+	})
+	if err != nil {
+		utils.SendError(w, http.StatusInternalServerError, "Can't sign challenge token, got an error: %s", err.Error())
+		return
+	}
+	utils.SendJSON(w, &twoFactorChallenge{TwoFactorRequired: true, ChallengeToken: challengeToken}, http.StatusOK)
+}
+
+// checkTwoFactorCode accepts either TOTP code or one of recovery codes, both are single-use
+func (s *server) checkTwoFactorCode(ctx context.Context, user *db.ShopUser, code string) (bool, error) {
+	filter := bson.D{bson.E{Key: "email", Value: user.Email}}
+	if step, ok := verifyTOTP(user.TOTPSecret, code, user.TOTPLastStep); ok {
+		filter = append(filter, bson.E{Key: "totp_last_step", Value: bson.D{bson.E{Key: "$lt", Value: step}}})
+		update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "totp_last_step", Value: step}}}}
+		matched, err := s.users.UpdateUser(ctx, &filter, &update)
+		return matched != 0, err
+	}
+	codeHash := hashSecret(code)
+	filter = append(filter, bson.E{Key: "recovery_codes", Value: codeHash})
+	update := bson.D{bson.E{Key: "$pull", Value: bson.D{bson.E{Key: "recovery_codes", Value: codeHash}}}}
+	matched, err := s.users.UpdateUser(ctx, &filter, &update)
+	return matched != 0, err
+}
+
+func (s *server) signInTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req twoFactorCodeRequest
+	if !utils.ReadJSON(w, r, &req) {
+		return
+	}
+	claims, err := validateToken(req.ChallengeToken, twoFactorChallengeTokenType, 0)
+	if err != nil {
+		utils.SendError(w, http.StatusUnauthorized, "Challenge token is expired or not correct: %s", err.Error())
+		return
+	}
+	email, _ := (*claims)["email"].(string)
+	setAuditEmail(r, email)
+	clientIP := getClientIP(r)
+	if !s.checkLockout(r.Context(), w, accountAttemptsKey(email), ipAttemptsKey(clientIP)) {
+		return
+	}
+	user, err := s.users.FindUser(r.Context(), email)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Got an error on find user: %s", err.Error())
+		return
+	}
+	if user == nil || !user.TOTPEnabled {
+		utils.SendError(w, http.StatusUnauthorized, "Two-factor authentication is not enabled")
+		return
+	}
+	ok, err := s.checkTwoFactorCode(r.Context(), user, req.Code)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't check two-factor code, got an error: %s", err.Error())
+		return
+	}
+	if !ok {
+		s.registerFailedSignIn(email, clientIP)
+		utils.SendError(w, http.StatusUnauthorized, "Two-factor code is not correct")
+		return
+	}
+	s.resetFailedSignIns(email)
+	err = checkUserStatus(user)
+	if err != nil {
+		sendCredentialsError(w, err)
+		return
+	}
+	tokens, err := s.issueTokens(user, "", nil, r)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't issue tokens pair, got an error: %s", err.Error())
+		return
+	}
+	utils.SendJSON(w, tokens, http.StatusOK)
+}
+
+func (s *server) enrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	claims := s.authorizeRequest(w, r)
+	if claims == nil {
+		return
+	}
+	email, ok := getClaimEmail(w, claims)
+	if !ok {
+		return
+	}
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		utils.SendError(w, http.StatusInternalServerError, "Can't generate secret, got an error: %s", err.Error())
+		return
+	}
+	filter := bson.D{
+		bson.E{Key: "email", Value: email},
+		bson.E{Key: "totp_enabled", Value: bson.D{bson.E{Key: "$ne", Value: true}}},
+	}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "totp_pending_secret", Value: secret}}}}
+	matched, err := s.users.UpdateUser(r.Context(), &filter, &update)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't store secret, got an error: %s", err.Error())
+		return
+	}
+	if matched == 0 {
+		utils.SendError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+	utils.SendJSON(w, &twoFactorEnrollment{
+		Secret:     secret,
+		OTPAuthURI: getTOTPURI(os.Getenv("TOTP_ISSUER"), email, secret),
+	}, http.StatusOK)
+}
+
+func (s *server) confirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	claims := s.authorizeRequest(w, r)
+	if claims == nil {
+		return
+	}
+	email, ok := getClaimEmail(w, claims)
+	if !ok {
+		return
+	}
+	var req twoFactorCodeRequest
+	if !utils.ReadJSON(w, r, &req) {
+		return
+	}
+	user, err := s.users.FindUser(r.Context(), email)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Got an error on find user: %s", err.Error())
+		return
+	}
+	if user == nil || len(user.TOTPPendingSecret) == 0 {
+		utils.SendError(w, http.StatusBadRequest, "Two-factor enrollment is not started")
+		return
+	}
+	step, ok := verifyTOTP(user.TOTPPendingSecret, req.Code, 0)
+	if !ok {
+		utils.SendError(w, http.StatusBadRequest, "Two-factor code is not correct")
+		return
+	}
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		utils.SendError(w, http.StatusInternalServerError, "Can't generate recovery codes, got an error: %s", err.Error())
+		return
+	}
+	codeHashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		codeHashes = append(codeHashes, hashSecret(code))
+	}
+	filter := bson.D{
+		bson.E{Key: "email", Value: email},
+		bson.E{Key: "totp_pending_secret", Value: user.TOTPPendingSecret},
+	}
+	update := bson.D{
+		bson.E{Key: "$set", Value: bson.D{
+			bson.E{Key: "totp_secret", Value: user.TOTPPendingSecret},
+			bson.E{Key: "totp_enabled", Value: true},
+			bson.E{Key: "totp_last_step", Value: step},
+			bson.E{Key: "recovery_codes", Value: codeHashes},
+		}},
+		bson.E{Key: "$unset", Value: bson.D{bson.E{Key: "totp_pending_secret", Value: ""}}},
+	}
+	matched, err := s.users.UpdateUser(r.Context(), &filter, &update)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't enable two-factor authentication, got an error: %s", err.Error())
+		return
+	}
+	if matched == 0 {
+		utils.SendError(w, http.StatusConflict, "Two-factor enrollment has been restarted, use the new secret")
+		return
+	}
+	// Recovery codes are shown only once, only their hashes are stored
+	utils.SendJSON(w, &twoFactorRecoveryCodes{RecoveryCodes: codes}, http.StatusOK)
+}
+
+// disableTwoFactor requires both password and code, so that stolen access token
+// alone can't turn off the second factor
+func (s *server) disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	claims := s.authorizeRequest(w, r)
+	if claims == nil {
+		return
+	}
+	email, ok := getClaimEmail(w, claims)
+	if !ok {
+		return
+	}
+	var req twoFactorDisableRequest
+	if !utils.ReadJSON(w, r, &req) {
+		return
+	}
+	clientIP := getClientIP(r)
+	user, err := s.checkCredentials(r.Context(), email, req.Password, clientIP)
+	if err != nil {
+		sendCredentialsError(w, err)
+		return
+	}
+	if !user.TOTPEnabled {
+		utils.SendError(w, http.StatusConflict, "Two-factor authentication is not enabled")
+		return
+	}
+	ok, err = s.checkTwoFactorCode(r.Context(), user, req.Code)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't check two-factor code, got an error: %s", err.Error())
+		return
+	}
+	if !ok {
+		s.registerFailedSignIn(email, clientIP)
+		utils.SendError(w, http.StatusUnauthorized, "Two-factor code is not correct")
+		return
+	}
+	filter := bson.D{
+		bson.E{Key: "email", Value: email},
+		bson.E{Key: "totp_enabled", Value: true},
+	}
+	update := bson.D{bson.E{Key: "$unset", Value: bson.D{
+		bson.E{Key: "totp_enabled", Value: ""},
+		bson.E{Key: "totp_secret", Value: ""},
+		bson.E{Key: "totp_pending_secret", Value: ""},
+		bson.E{Key: "totp_last_step", Value: ""},
+		bson.E{Key: "recovery_codes", Value: ""},
+	}}}
+	_, err = s.users.UpdateUser(r.Context(), &filter, &update)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't disable two-factor authentication, got an error: %s", err.Error())
+		return
+	}
+	utils.SendBodyResponse(w, "Two-factor authentication is disabled", http.StatusOK)
+}
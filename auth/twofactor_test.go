@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DenisAltruist/distsys/db"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestSignInTwoFactorChecksStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		user       db.ShopUser
+		wantStatus int
+	}{
+		{name: "active", user: db.ShopUser{Status: db.UserStatusActive}, wantStatus: http.StatusOK},
+		{name: "without status", user: db.ShopUser{}, wantStatus: http.StatusOK},
+		{name: "pending", user: db.ShopUser{Status: db.UserStatusPending}, wantStatus: http.StatusForbidden},
+		{name: "disabled", user: db.ShopUser{Status: db.UserStatusDisabled}, wantStatus: http.StatusForbidden},
+		{name: "password reset required", user: db.ShopUser{Status: db.UserStatusActive, PasswordResetRequired: true}, wantStatus: http.StatusForbidden},
+	}
+	secret := totpEncoding.EncodeToString(totpTestKey)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			user := tt.user
+			user.Email = "alice@example.com"
+			user.Roles = []string{db.RoleViewer}
+			user.TOTPEnabled = true
+			user.TOTPSecret = secret
+			user.TOTPLastStep = time.Now().Unix()/totpPeriod - 10 // set on confirmation
+			if err := s.users.AddNewUser(context.Background(), &user); err != nil {
+				t.Fatalf("Can't add user: %s", err.Error())
+			}
+			challengeToken, err := signToken(jwt.MapClaims{
+				"email": user.Email,
+				"type":  twoFactorChallengeTokenType,
+				"jti":   "challenge",
+				"exp":   time.Now().Add(time.Minute).Unix(),
+			})
+			if err != nil {
+				t.Fatalf("Can't sign challenge token: %s", err.Error())
+			}
+			body, _ := json.Marshal(&twoFactorCodeRequest{
+				ChallengeToken: challengeToken,
+				Code:           calcTOTP(totpTestKey, time.Now().Unix()/totpPeriod),
+			})
+			w := httptest.NewRecorder()
+			s.signInTwoFactor(w, httptest.NewRequest(http.MethodPut, "/signin/2fa", bytes.NewReader(body)))
+			if w.Code != tt.wantStatus {
+				t.Errorf("Status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestTwoFactorEnrollmentRequiresUser(t *testing.T) {
+	s := newTestServer(t)
+	tokens, err := issueClientToken(&db.OAuthClient{ID: "reporting", Roles: []string{db.RoleViewer}}, nil)
+	if err != nil {
+		t.Fatalf("Can't issue client token: %s", err.Error())
+	}
+	for name, handler := range map[string]http.HandlerFunc{"enroll": s.enrollTwoFactor, "confirm": s.confirmTwoFactor} {
+		r := httptest.NewRequest(http.MethodPost, "/2fa/"+name, bytes.NewReader([]byte(`{"code":"123456"}`)))
+		r.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Status of %s by client token = %d, want %d: %s", name, w.Code, http.StatusForbidden, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/DenisAltruist/distsys/db"
+	"github.com/DenisAltruist/distsys/utils"
+	jwt "github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const emailVerificationTokenType = "email_verification"
+
+// sendVerificationEmail issues new verification token for the pending user. Only the
+// last issued token is accepted, since its id is stored in the user document.
+func (s *server) sendVerificationEmail(ctx context.Context, email string) error {
+	tokenDur, err := strconv.Atoi(os.Getenv("EMAIL_VERIFICATION_TOKEN_DURATION_MINUTES"))
+	if err != nil {
+		return err
+	}
+	tokenID, err := newTokenID()
+	if err != nil {
+		return err
+	}
+	token, err := signToken(jwt.MapClaims{
+		"email": email,
+		"type":  emailVerificationTokenType,
+		"jti":   tokenID,
+		"exp":   time.Now().Add(time.Minute * time.Duration(tokenDur)).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	filter := bson.D{
+		bson.E{Key: "email", Value: email},
+		bson.E{Key: "status", Value: db.UserStatusPending},
+	}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "verification_token_id", Value: tokenID}}}}
+	matched, err := s.users.UpdateUser(ctx, &filter, &update)
+	if err != nil {
+		return err
+	}
+	if matched == 0 {
+		return nil // nothing to verify
+	}
+	link := fmt.Sprintf("%s?token=%s", os.Getenv("EMAIL_VERIFICATION_URL"), url.QueryEscape(token))
+	body := fmt.Sprintf("Please confirm your email by following the link:\n\n%s\n\nThe link expires in %d minutes.\n", link, tokenDur)
+	return mailer.Send(email, "Confirm your email", body)
+}
+
+func (s *server) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	claims, err := validateToken(r.FormValue("token"), emailVerificationTokenType, 0)
+	if err != nil {
+		utils.SendError(w, http.StatusBadRequest, "Verification token is expired or not correct: %s", err.Error())
+		return
+	}
+	email, _ := (*claims)["email"].(string)
+	setAuditEmail(r, email)
+	tokenID, _ := (*claims)["jti"].(string)
+	filter := bson.D{
+		bson.E{Key: "email", Value: email},
+		bson.E{Key: "status", Value: db.UserStatusPending},
+		bson.E{Key: "verification_token_id", Value: tokenID},
+	}
+	update := bson.D{
+		bson.E{Key: "$set", Value: bson.D{bson.E{Key: "status", Value: db.UserStatusActive}}},
+		bson.E{Key: "$unset", Value: bson.D{bson.E{Key: "verification_token_id", Value: ""}}},
+	}
+	matched, err := s.users.UpdateUser(r.Context(), &filter, &update)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't verify email, got an error: %s", err.Error())
+		return
+	}
+	if matched == 0 {
+		utils.SendError(w, http.StatusBadRequest, "Verification token has already been used or replaced by a newer one")
+		return
+	}
+	utils.SendBodyResponse(w, "Email is verified", http.StatusOK)
+}
+
+func (s *server) resendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	user, ok := getShopUserFromReq(w, r)
+	if !ok {
+		return
+	}
+	err := s.sendVerificationEmail(r.Context(), user.Email)
+	if err != nil {
+		utils.SendError(w, db.ErrorStatus(err), "Can't send verification email, got an error: %s", err.Error())
+		return
+	}
+	// The same response for any email not to disclose which ones are registered
+	utils.SendBodyResponse(w, "Verification email is sent if the account is waiting for verification", http.StatusOK)
+}
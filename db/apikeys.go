@@ -0,0 +1,74 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	mgo "go.mongodb.org/mongo-driver/mongo"
+)
+
+// APIKey is a long-lived credential of machine clients acting on behalf of the user.
+// Only SHA-256 of the secret part of the key is stored.
+type APIKey struct {
+	ID         string     `bson:"key_id" json:"id"`
+	Email      string     `bson:"email" json:"email"`
+	Name       string     `bson:"name" json:"name"`
+	Scopes     []string   `bson:"scopes" json:"scopes"`
+	KeyHash    string     `bson:"key_hash" json:"-"`
+	CreatedAt  time.Time  `bson:"created_at" json:"created_at"`
+	LastUsedAt *time.Time `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+	Revoked    bool       `bson:"revoked" json:"revoked"`
+}
+
+func AddAPIKey(ctx context.Context, client *mgo.Client, key *APIKey) (err error) {
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getAPIKeysCollection(client)
+	insertRes, err := collection.InsertOne(ctx, key)
+	if err != nil {
+		return err
+	}
+	log.Printf("Inserted doc id: %s", insertRes.InsertedID)
+	return nil
+}
+
+func FindAPIKeys(ctx context.Context, client *mgo.Client, filter *bson.D) (keys []*APIKey, err error) {
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getAPIKeysCollection(client)
+	cur, err := collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	result := []*APIKey{}
+	for cur.Next(ctx) {
+		var curKey APIKey
+		err = cur.Decode(&curKey)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, &curKey)
+	}
+	if cur.Err() != nil {
+		return nil, cur.Err()
+	}
+	return result, nil
+}
+
+func UpdateAPIKeys(ctx context.Context, client *mgo.Client, filter *bson.D, update *bson.D) (matched int64, err error) {
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getAPIKeysCollection(client)
+	updateRes, err := collection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Matched count: %d\n", updateRes.MatchedCount)
+	return updateRes.MatchedCount, nil
+}
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	mgo "go.mongodb.org/mongo-driver/mongo"
+	mgopts "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LoginAttempts counts failed sign ins by key, i.e. by account or by client IP
+type LoginAttempts struct {
+	Key         string    `bson:"key" json:"key"`
+	Failures    int64     `bson:"failures" json:"failures"`
+	LockedUntil time.Time `bson:"locked_until" json:"locked_until"`
+	UpdatedAt   time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+func FindLoginAttempts(ctx context.Context, client *mgo.Client, filter *bson.D) (attempts *LoginAttempts, err error) {
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getAttemptsCollection(client)
+	var res LoginAttempts
+	err = collection.FindOne(ctx, filter).Decode(&res)
+	if err == mgo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// AddFailedLoginAttempt increments failures counter of the key and returns its state before the update
+func AddFailedLoginAttempt(ctx context.Context, client *mgo.Client, key string) (attempts *LoginAttempts, err error) {
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getAttemptsCollection(client)
+	filter := bson.D{bson.E{Key: "key", Value: key}}
+	update := bson.D{
+		bson.E{Key: "$inc", Value: bson.D{bson.E{Key: "failures", Value: 1}}},
+		bson.E{Key: "$set", Value: bson.D{bson.E{Key: "updated_at", Value: time.Now()}}},
+	}
+	var res LoginAttempts
+	err = collection.FindOneAndUpdate(ctx, filter, update, mgopts.FindOneAndUpdate().SetUpsert(true)).Decode(&res)
+	if err == mgo.ErrNoDocuments {
+		return &LoginAttempts{Key: key}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func UpdateLoginAttempts(ctx context.Context, client *mgo.Client, filter *bson.D, update *bson.D) (err error) {
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getAttemptsCollection(client)
+	_, err = collection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+func RemoveLoginAttempts(ctx context.Context, client *mgo.Client, filter *bson.D) (removed int64, err error) {
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getAttemptsCollection(client)
+	delRes, err := collection.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Deleted documents count for %v: %d\n", filter, delRes.DeletedCount)
+	return delRes.DeletedCount, nil
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	mgo "go.mongodb.org/mongo-driver/mongo"
+	mgopts "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+	AuditOutcomeError   = "error"
+)
+
+// IndexOptionsConflict code of mongo, returned when index exists with other options
+const indexOptionsConflictCode = 85
+
+// AuditEvent is appended for every request to the auth service, Email is the one
+// who made the request and Target is the user the request was about, if differs
+type AuditEvent struct {
+	Type      string    `bson:"type" json:"type"`
+	Email     string    `bson:"email,omitempty" json:"email,omitempty"`
+	Target    string    `bson:"target,omitempty" json:"target,omitempty"`
+	IP        string    `bson:"ip" json:"ip"`
+	UserAgent string    `bson:"user_agent" json:"user_agent"`
+	Outcome   string    `bson:"outcome" json:"outcome"`
+	Status    int       `bson:"status" json:"status"`
+	Reason    string    `bson:"reason,omitempty" json:"reason,omitempty"`
+	Time      time.Time `bson:"time" json:"time"`
+}
+
+type AuditEventsList struct {
+	Count int64         `json:"count"`
+	List  []*AuditEvent `json:"list"`
+}
+
+func AddAuditEvent(ctx context.Context, client *mgo.Client, event *AuditEvent) (err error) {
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getAuditCollection(client)
+	_, err = collection.InsertOne(ctx, event)
+	return err
+}
+
+func FindAuditEvents(ctx context.Context, client *mgo.Client, filter *bson.D, offset int64, limit int64) (events *AuditEventsList, err error) {
+	result := AuditEventsList{List: []*AuditEvent{}}
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getAuditCollection(client)
+	opts := mgopts.Find().SetSkip(offset).SetLimit(limit).SetSort(bson.D{bson.E{Key: "time", Value: -1}})
+	cur, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var curEvent AuditEvent
+		err = cur.Decode(&curEvent)
+		if err != nil {
+			return nil, err
+		}
+		result.List = append(result.List, &curEvent)
+	}
+	if cur.Err() != nil {
+		return nil, cur.Err()
+	}
+	numOfDocs, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	result.Count = numOfDocs
+	return &result, nil
+}
+
+// EnsureAuditIndexes makes mongo remove events older than retention, zero
+// retention keeps them forever
+func EnsureAuditIndexes(ctx context.Context, client *mgo.Client, retention time.Duration) (err error) {
+	ctx, cancel := withIndexTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getAuditCollection(client)
+	keys := bson.D{bson.E{Key: "time", Value: 1}}
+	if retention > 0 {
+		return ensureTTLIndex(ctx, collection, "time", retention)
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mgo.IndexModel{Keys: keys})
+	if cmdErr, ok := err.(mgo.CommandError); ok && cmdErr.Code == indexOptionsConflictCode {
+		log.Printf("Audit index has expiration, drop it to keep events forever\n")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Ensured audit index with retention %s\n", retention)
+	return nil
+}
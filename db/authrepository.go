@@ -0,0 +1,471 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	mgo "go.mongodb.org/mongo-driver/mongo"
+)
+
+// Filters and updates of auth repositories are mongo queries, embedded storages
+// evaluate operators used by the auth service, see documents.go
+
+type TokenRepository interface {
+	AddRefreshToken(ctx context.Context, token *RefreshTokenRecord) error
+	// FindRefreshToken returns nil if no token matches the filter
+	FindRefreshToken(ctx context.Context, filter *bson.D) (*RefreshTokenRecord, error)
+	FindRefreshTokens(ctx context.Context, filter *bson.D) ([]*RefreshTokenRecord, error)
+	// UpdateRefreshTokens updates all matching tokens and returns their count
+	UpdateRefreshTokens(ctx context.Context, filter *bson.D, update *bson.D) (int64, error)
+}
+
+type SessionRepository interface {
+	AddSession(ctx context.Context, session *Session) error
+	// FindSessions returns sessions refreshed last first
+	FindSessions(ctx context.Context, filter *bson.D) ([]*Session, error)
+	UpdateSessions(ctx context.Context, filter *bson.D, update *bson.D) (int64, error)
+}
+
+type RevocationRepository interface {
+	// AddRevokedTokens skips tokens revoked before
+	AddRevokedTokens(ctx context.Context, tokens []*RevokedToken) error
+	IsTokenRevoked(ctx context.Context, filter *bson.D) (bool, error)
+}
+
+type AttemptRepository interface {
+	// FindLoginAttempts returns nil if there are no failures of the key
+	FindLoginAttempts(ctx context.Context, filter *bson.D) (*LoginAttempts, error)
+	AddFailedLoginAttempt(ctx context.Context, key string) (*LoginAttempts, error)
+	UpdateLoginAttempts(ctx context.Context, filter *bson.D, update *bson.D) error
+	RemoveLoginAttempts(ctx context.Context, filter *bson.D) (int64, error)
+}
+
+type APIKeyRepository interface {
+	AddAPIKey(ctx context.Context, key *APIKey) error
+	FindAPIKeys(ctx context.Context, filter *bson.D) ([]*APIKey, error)
+	UpdateAPIKeys(ctx context.Context, filter *bson.D, update *bson.D) (int64, error)
+}
+
+type OAuthClientRepository interface {
+	AddOAuthClient(ctx context.Context, oauthClient *OAuthClient) error
+	// FindOAuthClient returns nil if no client matches the filter
+	FindOAuthClient(ctx context.Context, filter *bson.D) (*OAuthClient, error)
+	UpdateOAuthClient(ctx context.Context, filter *bson.D, update *bson.D) (int64, error)
+}
+
+type AuditRepository interface {
+	AddAuditEvent(ctx context.Context, event *AuditEvent) error
+	// FindAuditEvents returns the latest events first
+	FindAuditEvents(ctx context.Context, filter *bson.D, offset int64, limit int64) (*AuditEventsList, error)
+}
+
+// AuthRepositories are collections of the auth service
+type AuthRepositories struct {
+	Users       UserRepository
+	Tokens      TokenRepository
+	Sessions    SessionRepository
+	Revocations RevocationRepository
+	Attempts    AttemptRepository
+	APIKeys     APIKeyRepository
+	Clients     OAuthClientRepository
+	Audit       AuditRepository
+}
+
+// AuthRetention is how long embedded storages keep failed sign ins after the
+// last one and audit events, zero retention keeps them forever. Mongo applies
+// it by TTL indexes instead
+type AuthRetention struct {
+	Attempts time.Duration
+	Audit    time.Duration
+}
+
+// Names of auth collections in embedded storages
+const (
+	usersCollection       = "users"
+	tokensCollection      = "tokens"
+	sessionsCollection    = "sessions"
+	revocationsCollection = "revocations"
+	attemptsCollection    = "attempts"
+	apiKeysCollection     = "api_keys"
+	clientsCollection     = "clients"
+	auditCollection       = "audit"
+)
+
+// getAuthSchemas are counterparts of indexes created by Ensure*Indexes
+func getAuthSchemas(retention *AuthRetention) map[string]collectionSchema {
+	schemas := map[string]collectionSchema{
+		usersCollection:       {unique: []string{"email"}},
+		tokensCollection:      {unique: []string{"jti"}, expireField: "expires_at"},
+		sessionsCollection:    {unique: []string{"session_id"}, expireField: "expires_at"},
+		revocationsCollection: {unique: []string{"jti"}, expireField: "expires_at"},
+		attemptsCollection:    {unique: []string{"key"}},
+		apiKeysCollection:     {unique: []string{"key_id"}},
+		clientsCollection:     {unique: []string{"client_id"}},
+		auditCollection:       {},
+	}
+	if retention.Attempts > 0 {
+		schemas[attemptsCollection] = collectionSchema{unique: []string{"key"}, expireField: "updated_at", expireAfter: retention.Attempts}
+	}
+	if retention.Audit > 0 {
+		schemas[auditCollection] = collectionSchema{expireField: "time", expireAfter: retention.Audit}
+	}
+	return schemas
+}
+
+// MongoAuthRepository implements repositories of auth collections other than users
+type MongoAuthRepository struct {
+	client *mgo.Client
+}
+
+func NewMongoAuthRepositories(client *mgo.Client) *AuthRepositories {
+	r := &MongoAuthRepository{client: client}
+	return &AuthRepositories{
+		Users:       NewMongoUserRepository(client),
+		Tokens:      r,
+		Sessions:    r,
+		Revocations: r,
+		Attempts:    r,
+		APIKeys:     r,
+		Clients:     r,
+		Audit:       r,
+	}
+}
+
+func (r *MongoAuthRepository) AddRefreshToken(ctx context.Context, token *RefreshTokenRecord) error {
+	return AddRefreshToken(ctx, r.client, token)
+}
+
+func (r *MongoAuthRepository) FindRefreshToken(ctx context.Context, filter *bson.D) (*RefreshTokenRecord, error) {
+	return FindRefreshToken(ctx, r.client, filter)
+}
+
+func (r *MongoAuthRepository) FindRefreshTokens(ctx context.Context, filter *bson.D) ([]*RefreshTokenRecord, error) {
+	return FindRefreshTokens(ctx, r.client, filter)
+}
+
+func (r *MongoAuthRepository) UpdateRefreshTokens(ctx context.Context, filter *bson.D, update *bson.D) (int64, error) {
+	return UpdateRefreshTokens(ctx, r.client, filter, update)
+}
+
+func (r *MongoAuthRepository) AddSession(ctx context.Context, session *Session) error {
+	return AddSession(ctx, r.client, session)
+}
+
+func (r *MongoAuthRepository) FindSessions(ctx context.Context, filter *bson.D) ([]*Session, error) {
+	return FindSessions(ctx, r.client, filter)
+}
+
+func (r *MongoAuthRepository) UpdateSessions(ctx context.Context, filter *bson.D, update *bson.D) (int64, error) {
+	return UpdateSessions(ctx, r.client, filter, update)
+}
+
+func (r *MongoAuthRepository) AddRevokedTokens(ctx context.Context, tokens []*RevokedToken) error {
+	return AddRevokedTokens(ctx, r.client, tokens)
+}
+
+func (r *MongoAuthRepository) IsTokenRevoked(ctx context.Context, filter *bson.D) (bool, error) {
+	return IsTokenRevoked(ctx, r.client, filter)
+}
+
+func (r *MongoAuthRepository) FindLoginAttempts(ctx context.Context, filter *bson.D) (*LoginAttempts, error) {
+	return FindLoginAttempts(ctx, r.client, filter)
+}
+
+func (r *MongoAuthRepository) AddFailedLoginAttempt(ctx context.Context, key string) (*LoginAttempts, error) {
+	return AddFailedLoginAttempt(ctx, r.client, key)
+}
+
+func (r *MongoAuthRepository) UpdateLoginAttempts(ctx context.Context, filter *bson.D, update *bson.D) error {
+	return UpdateLoginAttempts(ctx, r.client, filter, update)
+}
+
+func (r *MongoAuthRepository) RemoveLoginAttempts(ctx context.Context, filter *bson.D) (int64, error) {
+	return RemoveLoginAttempts(ctx, r.client, filter)
+}
+
+func (r *MongoAuthRepository) AddAPIKey(ctx context.Context, key *APIKey) error {
+	return AddAPIKey(ctx, r.client, key)
+}
+
+func (r *MongoAuthRepository) FindAPIKeys(ctx context.Context, filter *bson.D) ([]*APIKey, error) {
+	return FindAPIKeys(ctx, r.client, filter)
+}
+
+func (r *MongoAuthRepository) UpdateAPIKeys(ctx context.Context, filter *bson.D, update *bson.D) (int64, error) {
+	return UpdateAPIKeys(ctx, r.client, filter, update)
+}
+
+func (r *MongoAuthRepository) AddOAuthClient(ctx context.Context, oauthClient *OAuthClient) error {
+	return AddOAuthClient(ctx, r.client, oauthClient)
+}
+
+func (r *MongoAuthRepository) FindOAuthClient(ctx context.Context, filter *bson.D) (*OAuthClient, error) {
+	return FindOAuthClient(ctx, r.client, filter)
+}
+
+func (r *MongoAuthRepository) UpdateOAuthClient(ctx context.Context, filter *bson.D, update *bson.D) (int64, error) {
+	return UpdateOAuthClient(ctx, r.client, filter, update)
+}
+
+func (r *MongoAuthRepository) AddAuditEvent(ctx context.Context, event *AuditEvent) error {
+	return AddAuditEvent(ctx, r.client, event)
+}
+
+func (r *MongoAuthRepository) FindAuditEvents(ctx context.Context, filter *bson.D, offset int64, limit int64) (*AuditEventsList, error) {
+	return FindAuditEvents(ctx, r.client, filter, offset, limit)
+}
+
+// documentAuthRepository implements repositories of all auth collections over
+// collections of embedded storage
+type documentAuthRepository struct {
+	collections map[string]documentCollection
+}
+
+func newDocumentAuthRepositories(collections map[string]documentCollection) *AuthRepositories {
+	r := &documentAuthRepository{collections: collections}
+	return &AuthRepositories{
+		Users:       r,
+		Tokens:      r,
+		Sessions:    r,
+		Revocations: r,
+		Attempts:    r,
+		APIKeys:     r,
+		Clients:     r,
+		Audit:       r,
+	}
+}
+
+func (r *documentAuthRepository) AddNewUser(ctx context.Context, user *ShopUser) error {
+	return insertDocument(r.collections[usersCollection], user)
+}
+
+func (r *documentAuthRepository) FindUser(ctx context.Context, email string) (*ShopUser, error) {
+	return r.FindUserBy(ctx, &bson.D{bson.E{Key: "email", Value: email}})
+}
+
+func (r *documentAuthRepository) FindUserBy(ctx context.Context, filter *bson.D) (*ShopUser, error) {
+	doc, err := findDocument(r.collections[usersCollection], filter)
+	if err != nil || doc == nil {
+		return nil, err
+	}
+	var user ShopUser
+	err = decodeDocument(doc, &user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *documentAuthRepository) FindUsers(ctx context.Context, filter *bson.D, offset int64, limit int64) (*UsersList, error) {
+	docs, count, err := findDocuments(r.collections[usersCollection], filter, findOptions{sortKey: "email", offset: offset, limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	result := UsersList{Count: count}
+	for _, doc := range docs {
+		var user ShopUser
+		err = decodeDocument(doc, &user)
+		if err != nil {
+			return nil, err
+		}
+		result.List = append(result.List, &user)
+	}
+	return &result, nil
+}
+
+func (r *documentAuthRepository) UpdateUser(ctx context.Context, filter *bson.D, update *bson.D) (int64, error) {
+	return updateDocuments(r.collections[usersCollection], filter, update, false)
+}
+
+func (r *documentAuthRepository) RemoveUser(ctx context.Context, filter *bson.D) (int64, error) {
+	return removeDocuments(r.collections[usersCollection], filter, false)
+}
+
+func (r *documentAuthRepository) AddRefreshToken(ctx context.Context, token *RefreshTokenRecord) error {
+	return insertDocument(r.collections[tokensCollection], token)
+}
+
+func (r *documentAuthRepository) FindRefreshToken(ctx context.Context, filter *bson.D) (*RefreshTokenRecord, error) {
+	doc, err := findDocument(r.collections[tokensCollection], filter)
+	if err != nil || doc == nil {
+		return nil, err
+	}
+	var token RefreshTokenRecord
+	err = decodeDocument(doc, &token)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (r *documentAuthRepository) FindRefreshTokens(ctx context.Context, filter *bson.D) ([]*RefreshTokenRecord, error) {
+	docs, _, err := findDocuments(r.collections[tokensCollection], filter, findOptions{})
+	if err != nil {
+		return nil, err
+	}
+	tokens := []*RefreshTokenRecord{}
+	for _, doc := range docs {
+		var token RefreshTokenRecord
+		err = decodeDocument(doc, &token)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &token)
+	}
+	return tokens, nil
+}
+
+func (r *documentAuthRepository) UpdateRefreshTokens(ctx context.Context, filter *bson.D, update *bson.D) (int64, error) {
+	return updateDocuments(r.collections[tokensCollection], filter, update, true)
+}
+
+func (r *documentAuthRepository) AddSession(ctx context.Context, session *Session) error {
+	return insertDocument(r.collections[sessionsCollection], session)
+}
+
+func (r *documentAuthRepository) FindSessions(ctx context.Context, filter *bson.D) ([]*Session, error) {
+	docs, _, err := findDocuments(r.collections[sessionsCollection], filter, findOptions{sortKey: "last_refreshed_at", sortDesc: true})
+	if err != nil {
+		return nil, err
+	}
+	sessions := []*Session{}
+	for _, doc := range docs {
+		var session Session
+		err = decodeDocument(doc, &session)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	return sessions, nil
+}
+
+func (r *documentAuthRepository) UpdateSessions(ctx context.Context, filter *bson.D, update *bson.D) (int64, error) {
+	return updateDocuments(r.collections[sessionsCollection], filter, update, true)
+}
+
+func (r *documentAuthRepository) AddRevokedTokens(ctx context.Context, tokens []*RevokedToken) error {
+	for _, token := range tokens {
+		err := insertDocument(r.collections[revocationsCollection], token)
+		if err != nil && err != ErrDuplicateKey {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *documentAuthRepository) IsTokenRevoked(ctx context.Context, filter *bson.D) (bool, error) {
+	doc, err := findDocument(r.collections[revocationsCollection], filter)
+	return doc != nil, err
+}
+
+func (r *documentAuthRepository) FindLoginAttempts(ctx context.Context, filter *bson.D) (*LoginAttempts, error) {
+	doc, err := findDocument(r.collections[attemptsCollection], filter)
+	if err != nil || doc == nil {
+		return nil, err
+	}
+	var attempts LoginAttempts
+	err = decodeDocument(doc, &attempts)
+	if err != nil {
+		return nil, err
+	}
+	return &attempts, nil
+}
+
+func (r *documentAuthRepository) AddFailedLoginAttempt(ctx context.Context, key string) (*LoginAttempts, error) {
+	filter := bson.D{bson.E{Key: "key", Value: key}}
+	update := bson.D{
+		bson.E{Key: "$inc", Value: bson.D{bson.E{Key: "failures", Value: 1}}},
+		bson.E{Key: "$set", Value: bson.D{bson.E{Key: "updated_at", Value: time.Now()}}},
+	}
+	before, err := upsertDocument(r.collections[attemptsCollection], filter, update)
+	if err != nil {
+		return nil, err
+	}
+	if before == nil {
+		return &LoginAttempts{Key: key}, nil
+	}
+	var attempts LoginAttempts
+	err = decodeDocument(before, &attempts)
+	if err != nil {
+		return nil, err
+	}
+	return &attempts, nil
+}
+
+func (r *documentAuthRepository) UpdateLoginAttempts(ctx context.Context, filter *bson.D, update *bson.D) error {
+	_, err := updateDocuments(r.collections[attemptsCollection], filter, update, false)
+	return err
+}
+
+func (r *documentAuthRepository) RemoveLoginAttempts(ctx context.Context, filter *bson.D) (int64, error) {
+	return removeDocuments(r.collections[attemptsCollection], filter, true)
+}
+
+func (r *documentAuthRepository) AddAPIKey(ctx context.Context, key *APIKey) error {
+	return insertDocument(r.collections[apiKeysCollection], key)
+}
+
+func (r *documentAuthRepository) FindAPIKeys(ctx context.Context, filter *bson.D) ([]*APIKey, error) {
+	docs, _, err := findDocuments(r.collections[apiKeysCollection], filter, findOptions{})
+	if err != nil {
+		return nil, err
+	}
+	keys := []*APIKey{}
+	for _, doc := range docs {
+		var key APIKey
+		err = decodeDocument(doc, &key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	return keys, nil
+}
+
+func (r *documentAuthRepository) UpdateAPIKeys(ctx context.Context, filter *bson.D, update *bson.D) (int64, error) {
+	return updateDocuments(r.collections[apiKeysCollection], filter, update, true)
+}
+
+func (r *documentAuthRepository) AddOAuthClient(ctx context.Context, oauthClient *OAuthClient) error {
+	return insertDocument(r.collections[clientsCollection], oauthClient)
+}
+
+func (r *documentAuthRepository) FindOAuthClient(ctx context.Context, filter *bson.D) (*OAuthClient, error) {
+	doc, err := findDocument(r.collections[clientsCollection], filter)
+	if err != nil || doc == nil {
+		return nil, err
+	}
+	var oauthClient OAuthClient
+	err = decodeDocument(doc, &oauthClient)
+	if err != nil {
+		return nil, err
+	}
+	return &oauthClient, nil
+}
+
+func (r *documentAuthRepository) UpdateOAuthClient(ctx context.Context, filter *bson.D, update *bson.D) (int64, error) {
+	return updateDocuments(r.collections[clientsCollection], filter, update, false)
+}
+
+func (r *documentAuthRepository) AddAuditEvent(ctx context.Context, event *AuditEvent) error {
+	return insertDocument(r.collections[auditCollection], event)
+}
+
+func (r *documentAuthRepository) FindAuditEvents(ctx context.Context, filter *bson.D, offset int64, limit int64) (*AuditEventsList, error) {
+	docs, count, err := findDocuments(r.collections[auditCollection], filter, findOptions{sortKey: "time", sortDesc: true, offset: offset, limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	result := AuditEventsList{Count: count, List: []*AuditEvent{}}
+	for _, doc := range docs {
+		var event AuditEvent
+		err = decodeDocument(doc, &event)
+		if err != nil {
+			return nil, err
+		}
+		result.List = append(result.List, &event)
+	}
+	return &result, nil
+}
@@ -0,0 +1,196 @@
+package db
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testAuthRepositories checks queries the auth service runs against embedded storage
+func testAuthRepositories(t *testing.T, repos *AuthRepositories) {
+	ctx := context.Background()
+	for _, user := range []*ShopUser{
+		{Email: "carol@example.com", Roles: []string{RoleViewer}, Status: UserStatusPending},
+		{Email: "alice@example.com", Roles: []string{RoleAdmin, RoleViewer}},
+		{Email: "bob@example.com", Roles: []string{RoleEditor}, Status: UserStatusDisabled},
+	} {
+		if err := repos.Users.AddNewUser(ctx, user); err != nil {
+			t.Fatalf("Can't add user %s: %s", user.Email, err.Error())
+		}
+	}
+
+	t.Run("find users", func(t *testing.T) {
+		tests := []struct {
+			name       string
+			filter     bson.D
+			offset     int64
+			limit      int64
+			wantCount  int64
+			wantEmails []string
+		}{
+			{name: "all sorted by email", wantCount: 3, wantEmails: []string{"alice@example.com", "bob@example.com", "carol@example.com"}},
+			{name: "page", offset: 1, limit: 1, wantCount: 3, wantEmails: []string{"bob@example.com"}},
+			{name: "role in array", filter: bson.D{bson.E{Key: "roles", Value: RoleViewer}}, wantCount: 2, wantEmails: []string{"alice@example.com", "carol@example.com"}},
+			{name: "missing status as null", filter: bson.D{bson.E{Key: "status", Value: bson.D{bson.E{Key: "$in", Value: bson.A{UserStatusActive, nil}}}}}, wantCount: 1, wantEmails: []string{"alice@example.com"}},
+			{name: "case insensitive regex", filter: bson.D{bson.E{Key: "email", Value: primitive.Regex{Pattern: regexp.QuoteMeta("BOB@"), Options: "i"}}}, wantCount: 1, wantEmails: []string{"bob@example.com"}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				users, err := repos.Users.FindUsers(ctx, &tt.filter, tt.offset, tt.limit)
+				if err != nil {
+					t.Fatalf("Unexpected error: %s", err.Error())
+				}
+				if users.Count != tt.wantCount || len(users.List) != len(tt.wantEmails) {
+					t.Fatalf("Got %d of %d users, want %v of %d", len(users.List), users.Count, tt.wantEmails, tt.wantCount)
+				}
+				for i, user := range users.List {
+					if user.Email != tt.wantEmails[i] {
+						t.Errorf("User %d is %s, want %s", i, user.Email, tt.wantEmails[i])
+					}
+				}
+			})
+		}
+	})
+
+	t.Run("update user", func(t *testing.T) {
+		filter := bson.D{bson.E{Key: "email", Value: "carol@example.com"}, bson.E{Key: "status", Value: UserStatusPending}}
+		update := bson.D{
+			bson.E{Key: "$set", Value: bson.D{bson.E{Key: "status", Value: UserStatusActive}}},
+			bson.E{Key: "$addToSet", Value: bson.D{bson.E{Key: "roles", Value: RoleViewer}}},
+		}
+		for _, wantMatched := range []int64{1, 0} {
+			matched, err := repos.Users.UpdateUser(ctx, &filter, &update)
+			if err != nil || matched != wantMatched {
+				t.Fatalf("Matched %d users with error %v, want %d", matched, err, wantMatched)
+			}
+		}
+		user, err := repos.Users.FindUser(ctx, "carol@example.com")
+		if err != nil || user.Status != UserStatusActive || len(user.Roles) != 1 {
+			t.Errorf("Got user %+v with error %v, want active viewer", user, err)
+		}
+	})
+
+	t.Run("revoke refresh tokens", func(t *testing.T) {
+		for _, jti := range []string{"1", "2", "3"} {
+			err := repos.Tokens.AddRefreshToken(ctx, &RefreshTokenRecord{ID: jti, FamilyID: "f", Email: "alice@example.com", ExpiresAt: time.Now().Add(time.Hour)})
+			if err != nil {
+				t.Fatalf("Can't add token %s: %s", jti, err.Error())
+			}
+		}
+		err := repos.Tokens.AddRefreshToken(ctx, &RefreshTokenRecord{ID: "1", ExpiresAt: time.Now().Add(time.Hour)})
+		if !IsDuplicateKeyError(err) {
+			t.Errorf("Got error %v, want duplicate key", err)
+		}
+		filter := bson.D{bson.E{Key: "family_id", Value: "f"}, bson.E{Key: "jti", Value: bson.D{bson.E{Key: "$ne", Value: "2"}}}}
+		update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "revoked", Value: true}}}}
+		matched, err := repos.Tokens.UpdateRefreshTokens(ctx, &filter, &update)
+		if err != nil || matched != 2 {
+			t.Fatalf("Revoked %d tokens with error %v, want 2", matched, err)
+		}
+		revokedFilter := bson.D{bson.E{Key: "revoked", Value: false}}
+		tokens, err := repos.Tokens.FindRefreshTokens(ctx, &revokedFilter)
+		if err != nil || len(tokens) != 1 || tokens[0].ID != "2" {
+			t.Errorf("Got not revoked tokens %+v with error %v, want 2", tokens, err)
+		}
+	})
+
+	t.Run("expired tokens", func(t *testing.T) {
+		err := repos.Revocations.AddRevokedTokens(ctx, []*RevokedToken{
+			{ID: "a", ExpiresAt: time.Now().Add(time.Hour)},
+			{ID: "b", ExpiresAt: time.Now().Add(-time.Second)},
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		// revoking again is not an error
+		err = repos.Revocations.AddRevokedTokens(ctx, []*RevokedToken{{ID: "a", ExpiresAt: time.Now().Add(time.Hour)}})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		for jti, want := range map[string]bool{"a": true, "b": false, "c": false} {
+			filter := bson.D{bson.E{Key: "jti", Value: jti}}
+			isRevoked, err := repos.Revocations.IsTokenRevoked(ctx, &filter)
+			if err != nil || isRevoked != want {
+				t.Errorf("Token %s revoked: %t with error %v, want %t", jti, isRevoked, err, want)
+			}
+		}
+	})
+
+	t.Run("sessions sorted by last refresh", func(t *testing.T) {
+		now := time.Now()
+		for i, id := range []string{"old", "new", "middle"} {
+			lastRefreshedAt := map[string]time.Time{"old": now.Add(-time.Hour), "new": now, "middle": now.Add(-time.Minute)}[id]
+			err := repos.Sessions.AddSession(ctx, &Session{ID: id, Email: "alice@example.com", LastRefreshedAt: lastRefreshedAt, ExpiresAt: now.Add(time.Duration(i+1) * time.Hour)})
+			if err != nil {
+				t.Fatalf("Can't add session %s: %s", id, err.Error())
+			}
+		}
+		filter := bson.D{bson.E{Key: "email", Value: "alice@example.com"}, bson.E{Key: "expires_at", Value: bson.D{bson.E{Key: "$gt", Value: now}}}}
+		sessions, err := repos.Sessions.FindSessions(ctx, &filter)
+		if err != nil || len(sessions) != 3 {
+			t.Fatalf("Got %d sessions with error %v, want 3", len(sessions), err)
+		}
+		for i, want := range []string{"new", "middle", "old"} {
+			if sessions[i].ID != want {
+				t.Errorf("Session %d is %s, want %s", i, sessions[i].ID, want)
+			}
+		}
+	})
+
+	t.Run("failed sign ins", func(t *testing.T) {
+		for _, wantFailures := range []int64{0, 1, 2} {
+			before, err := repos.Attempts.AddFailedLoginAttempt(ctx, "account:alice@example.com")
+			if err != nil || before.Failures != wantFailures {
+				t.Fatalf("Got attempts %+v with error %v before failure, want %d failures", before, err, wantFailures)
+			}
+		}
+		filter := bson.D{bson.E{Key: "key", Value: "account:alice@example.com"}}
+		attempts, err := repos.Attempts.FindLoginAttempts(ctx, &filter)
+		if err != nil || attempts == nil || attempts.Failures != 3 {
+			t.Fatalf("Got attempts %+v with error %v, want 3 failures", attempts, err)
+		}
+		keysFilter := bson.D{bson.E{Key: "key", Value: bson.D{bson.E{Key: "$in", Value: bson.A{"account:alice@example.com", "ip:127.0.0.1"}}}}}
+		removed, err := repos.Attempts.RemoveLoginAttempts(ctx, &keysFilter)
+		if err != nil || removed != 1 {
+			t.Errorf("Removed %d attempts with error %v, want 1", removed, err)
+		}
+	})
+
+	t.Run("audit events", func(t *testing.T) {
+		now := time.Now()
+		for i, eventType := range []string{"signin", "signout", "signin"} {
+			err := repos.Audit.AddAuditEvent(ctx, &AuditEvent{Type: eventType, Email: "alice@example.com", Time: now.Add(time.Duration(i) * time.Second)})
+			if err != nil {
+				t.Fatalf("Can't add event: %s", err.Error())
+			}
+		}
+		filter := bson.D{
+			bson.E{Key: "$or", Value: bson.A{
+				bson.D{bson.E{Key: "email", Value: "alice@example.com"}},
+				bson.D{bson.E{Key: "target", Value: "alice@example.com"}},
+			}},
+			bson.E{Key: "type", Value: "signin"},
+			bson.E{Key: "time", Value: bson.D{bson.E{Key: "$gte", Value: now}}},
+		}
+		events, err := repos.Audit.FindAuditEvents(ctx, &filter, 0, 10)
+		if err != nil || events.Count != 2 || len(events.List) != 2 {
+			t.Fatalf("Got events %+v with error %v, want 2", events, err)
+		}
+		if !events.List[0].Time.After(events.List[1].Time) {
+			t.Errorf("Events are not sorted latest first: %+v", events.List)
+		}
+		unknown := bson.D{bson.E{Key: "type", Value: "unknown"}}
+		events, err = repos.Audit.FindAuditEvents(ctx, &unknown, 0, 10)
+		if err != nil || events.List == nil {
+			t.Errorf("Got events %+v with error %v, want empty list", events, err)
+		}
+	})
+}
+
+func TestMemoryAuthRepositories(t *testing.T) {
+	testAuthRepositories(t, NewMemoryAuthRepositories(&AuthRetention{Attempts: time.Hour}))
+}
@@ -0,0 +1,310 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Buckets of the embedded storage. Items are kept by sequence number, so that
+// they are listed in order of addition as in mongo, codes and categories are
+// indexes pointing to sequence numbers. Keys of categories index are category,
+// zero byte and sequence number, so that empty category can be indexed too.
+var (
+	itemsBucket          = []byte("items")
+	itemCodesBucket      = []byte("item_codes")
+	itemCategoriesBucket = []byte("item_categories")
+)
+
+// BoltStore is embedded storage of items or auth collections in a single file,
+// documents are encoded with bson as in mongo.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func OpenBoltStore(path string) (*BoltStore, error) {
+	boltDB, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = boltDB.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{itemsBucket, itemCodesBucket, itemCategoriesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		boltDB.Close()
+		return nil, err
+	}
+	return &BoltStore{db: boltDB}, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) Items() *BoltItemRepository {
+	return &BoltItemRepository{db: s.db}
+}
+
+// Auth creates buckets of auth collections, each of them keeps documents by
+// sequence number
+func (s *BoltStore) Auth(retention *AuthRetention) (*AuthRepositories, error) {
+	schemas := getAuthSchemas(retention)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for name := range schemas {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	collections := make(map[string]documentCollection)
+	for name, schema := range schemas {
+		collections[name] = &boltCollection{db: s.db, bucket: []byte(name), schema: schema}
+	}
+	return newDocumentAuthRepositories(collections), nil
+}
+
+// boltCollection loads the whole bucket within transaction, so operations are
+// atomic as in memory
+type boltCollection struct {
+	db     *bolt.DB
+	bucket []byte
+	schema collectionSchema
+}
+
+func (c *boltCollection) transact(write bool, fn func(set *documentSet) error) error {
+	run := c.db.View
+	if write {
+		run = c.db.Update
+	}
+	return run(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(c.bucket)
+		var docs []*storedDocument
+		err := bucket.ForEach(func(key []byte, data []byte) error {
+			var doc bson.M
+			// values are valid only within transaction
+			err := bson.Unmarshal(append([]byte{}, data...), &doc)
+			if err != nil {
+				return err
+			}
+			docs = append(docs, &storedDocument{key: append([]byte{}, key...), doc: doc})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		set := newDocumentSet(&c.schema, docs)
+		err = fn(set)
+		if err != nil || !write {
+			return err
+		}
+		for _, stored := range set.docs {
+			if !stored.changed {
+				continue
+			}
+			if stored.removed {
+				if stored.key != nil {
+					err = bucket.Delete(stored.key)
+				}
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if stored.key == nil {
+				seq, err := bucket.NextSequence()
+				if err != nil {
+					return err
+				}
+				stored.key = sequenceKey(seq)
+			}
+			data, err := bson.Marshal(stored.doc)
+			if err != nil {
+				return err
+			}
+			err = bucket.Put(stored.key, data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+type BoltItemRepository struct {
+	db *bolt.DB
+}
+
+func sequenceKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+func categoryKey(category string, key []byte) []byte {
+	return append(append([]byte(category), 0), key...)
+}
+
+func getItem(tx *bolt.Tx, key []byte) (*StoreItem, error) {
+	data := tx.Bucket(itemsBucket).Get(key)
+	if data == nil {
+		return nil, fmt.Errorf("Item %x is indexed, but not stored", key)
+	}
+	var item StoreItem
+	err := bson.Unmarshal(data, &item)
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// putItem stores item under the key and indexes it
+func putItem(tx *bolt.Tx, key []byte, item *StoreItem) error {
+	data, err := bson.Marshal(item)
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(itemsBucket).Put(key, data)
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(itemCodesBucket).Put([]byte(item.Code), key)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(itemCategoriesBucket).Put(categoryKey(item.Category, key), []byte{})
+}
+
+// deleteItem removes item under the key and its indexes
+func deleteItem(tx *bolt.Tx, key []byte, item *StoreItem) error {
+	err := tx.Bucket(itemsBucket).Delete(key)
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(itemCodesBucket).Delete([]byte(item.Code))
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(itemCategoriesBucket).Delete(categoryKey(item.Category, key))
+}
+
+func (r *BoltItemRepository) AddItem(ctx context.Context, item *StoreItem) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(itemCodesBucket).Get([]byte(item.Code)) != nil {
+			return ErrDuplicateKey
+		}
+		seq, err := tx.Bucket(itemsBucket).NextSequence()
+		if err != nil {
+			return err
+		}
+		return putItem(tx, sequenceKey(seq), item)
+	})
+}
+
+func (r *BoltItemRepository) FindItems(ctx context.Context, filter *ItemFilter, offset int64, limit int64) (*StoreItemsList, error) {
+	var result StoreItemsList
+	err := r.db.View(func(tx *bolt.Tx) error {
+		// the most selective index is used, the rest of filter is checked on items
+		var cursor *bolt.Cursor
+		if len(filter.Code) != 0 {
+			key := tx.Bucket(itemCodesBucket).Get([]byte(filter.Code))
+			if key == nil {
+				return nil
+			}
+			item, err := getItem(tx, key)
+			if err != nil || !filter.matches(item) {
+				return err
+			}
+			result.Count = 1
+			if offset == 0 {
+				result.List = append(result.List, item)
+			}
+			return nil
+		}
+		// keys are sequence numbers, either as is or after prefix of the category
+		var prefix []byte
+		if len(filter.Category) != 0 {
+			prefix = categoryKey(filter.Category, nil)
+			cursor = tx.Bucket(itemCategoriesBucket).Cursor()
+		} else {
+			cursor = tx.Bucket(itemsBucket).Cursor()
+		}
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			if len(key) != len(prefix)+8 { // another category starting with the same bytes
+				continue
+			}
+			// zero limit means no limit as in mongo
+			if result.Count >= offset && (limit == 0 || result.Count < offset+limit) {
+				item, err := getItem(tx, key[len(prefix):])
+				if err != nil {
+					return err
+				}
+				result.List = append(result.List, item)
+			}
+			result.Count++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (r *BoltItemRepository) UpdateItem(ctx context.Context, code string, owner string, item *StoreItem) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		key := tx.Bucket(itemCodesBucket).Get([]byte(code))
+		if key == nil {
+			return fmt.Errorf("Can't match item with code %s", code)
+		}
+		key = append([]byte{}, key...) // values are valid only until the next change
+		stored, err := getItem(tx, key)
+		if err != nil {
+			return err
+		}
+		if len(owner) != 0 && stored.CreatedBy != owner {
+			return fmt.Errorf("Can't match item with code %s", code)
+		}
+		if item.Code != code && tx.Bucket(itemCodesBucket).Get([]byte(item.Code)) != nil {
+			return ErrDuplicateKey
+		}
+		updated := *item
+		keepItemFields(&updated, stored)
+		err = deleteItem(tx, key, stored)
+		if err != nil {
+			return err
+		}
+		return putItem(tx, key, &updated)
+	})
+}
+
+func (r *BoltItemRepository) RemoveItem(ctx context.Context, code string) (int64, error) {
+	var removed int64
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		key := tx.Bucket(itemCodesBucket).Get([]byte(code))
+		if key == nil {
+			return nil
+		}
+		key = append([]byte{}, key...)
+		item, err := getItem(tx, key)
+		if err != nil {
+			return err
+		}
+		removed = 1
+		return deleteItem(tx, key, item)
+	})
+	return removed, err
+}
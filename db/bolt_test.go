@@ -0,0 +1,219 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestBoltStore(t *testing.T) *BoltStore {
+	store, err := OpenBoltStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Can't open embedded storage: %s", err.Error())
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func newTestBoltItemRepository(t *testing.T) *BoltItemRepository {
+	repo := openTestBoltStore(t).Items()
+	for _, item := range []*StoreItem{
+		{Name: "laptop", Code: "1", Category: "a", CreatedBy: "alice@example.com"},
+		{Name: "phone", Code: "2", Category: "ab", CreatedBy: "bob@example.com"},
+		{Name: "book", Code: "3", Category: "a", CreatedBy: "alice@example.com"},
+		{Name: "pen", Code: "4", Category: ""},
+		{Name: "tablet", Code: "5", Category: "a"},
+	} {
+		if err := repo.AddItem(context.Background(), item); err != nil {
+			t.Fatalf("Can't add item %s: %s", item.Code, err.Error())
+		}
+	}
+	return repo
+}
+
+func TestBoltItemRepositoryFindItems(t *testing.T) {
+	repo := newTestBoltItemRepository(t)
+	tests := []struct {
+		name      string
+		filter    ItemFilter
+		offset    int64
+		limit     int64
+		wantCount int64
+		wantCodes []string
+	}{
+		{name: "all", wantCount: 5, wantCodes: []string{"1", "2", "3", "4", "5"}},
+		{name: "by code", filter: ItemFilter{Code: "3"}, wantCount: 1, wantCodes: []string{"3"}},
+		{name: "unknown code", filter: ItemFilter{Code: "6"}, wantCount: 0},
+		{name: "by code, offset", filter: ItemFilter{Code: "3"}, offset: 1, wantCount: 1},
+		{name: "category prefix of another", filter: ItemFilter{Category: "a"}, wantCount: 3, wantCodes: []string{"1", "3", "5"}},
+		{name: "category with prefix of another", filter: ItemFilter{Category: "ab"}, wantCount: 1, wantCodes: []string{"2"}},
+		{name: "prefix of categories", filter: ItemFilter{Category: "b"}, wantCount: 0},
+		{name: "code and category", filter: ItemFilter{Code: "2", Category: "a"}, wantCount: 0},
+		{name: "limit", limit: 2, wantCount: 5, wantCodes: []string{"1", "2"}},
+		{name: "offset", offset: 3, wantCount: 5, wantCodes: []string{"4", "5"}},
+		{name: "offset and limit", filter: ItemFilter{Category: "a"}, offset: 1, limit: 1, wantCount: 3, wantCodes: []string{"3"}},
+		{name: "offset past the end", offset: 10, wantCount: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := repo.FindItems(context.Background(), &tt.filter, tt.offset, tt.limit)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err.Error())
+			}
+			if res.Count != tt.wantCount {
+				t.Errorf("Count = %d, want %d", res.Count, tt.wantCount)
+			}
+			if len(res.List) != len(tt.wantCodes) {
+				t.Fatalf("Got %d items, want %v", len(res.List), tt.wantCodes)
+			}
+			for i, item := range res.List {
+				if item.Code != tt.wantCodes[i] {
+					t.Errorf("Item %d has code %s, want %s", i, item.Code, tt.wantCodes[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBoltItemRepositoryAddDuplicate(t *testing.T) {
+	repo := newTestBoltItemRepository(t)
+	err := repo.AddItem(context.Background(), &StoreItem{Name: "tablet", Code: "1"})
+	if !IsDuplicateKeyError(err) {
+		t.Errorf("Got error %v, want duplicate key", err)
+	}
+	res, _ := repo.FindItems(context.Background(), &ItemFilter{}, 0, 0)
+	if res.Count != 5 {
+		t.Errorf("Count = %d after rejected item, want 5", res.Count)
+	}
+}
+
+func TestBoltItemRepositoryUpdateItem(t *testing.T) {
+	tests := []struct {
+		name         string
+		code         string
+		owner        string
+		item         StoreItem
+		wantErr      bool
+		wantDup      bool
+		wantCode     string
+		wantCategory map[string][]string
+	}{
+		{name: "by admin", code: "2", item: StoreItem{Name: "smartphone", Code: "2", Category: "ab"}, wantCode: "2"},
+		{name: "by creator", code: "1", owner: "alice@example.com", item: StoreItem{Name: "notebook", Code: "1", Category: "a"}, wantCode: "1"},
+		{name: "by another editor", code: "2", owner: "alice@example.com", item: StoreItem{Name: "smartphone", Code: "2"}, wantErr: true},
+		{name: "item without creator", code: "4", owner: "alice@example.com", item: StoreItem{Name: "pencil", Code: "4"}, wantErr: true},
+		{name: "unknown code", code: "6", item: StoreItem{Name: "watch", Code: "6"}, wantErr: true},
+		{name: "code of another item", code: "3", item: StoreItem{Name: "book", Code: "1", Category: "a"}, wantErr: true, wantDup: true},
+		{
+			name: "new code", code: "3", item: StoreItem{Name: "book", Code: "30", Category: "a"}, wantCode: "30",
+			wantCategory: map[string][]string{"a": {"1", "30", "5"}},
+		},
+		{
+			name: "new category", code: "1", item: StoreItem{Name: "laptop", Code: "1", Category: "ab"}, wantCode: "1",
+			wantCategory: map[string][]string{"a": {"3", "5"}, "ab": {"1", "2"}},
+		},
+		{
+			name: "new code and category", code: "5", item: StoreItem{Name: "tablet", Code: "50", Category: "c"}, wantCode: "50",
+			wantCategory: map[string][]string{"a": {"1", "3"}, "c": {"50"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newTestBoltItemRepository(t)
+			err := repo.UpdateItem(context.Background(), tt.code, tt.owner, &tt.item)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Got error %v, want error: %t", err, tt.wantErr)
+			}
+			if tt.wantDup && !IsDuplicateKeyError(err) {
+				t.Errorf("Got error %v, want duplicate key", err)
+			}
+			if tt.wantErr {
+				return
+			}
+			res, err := repo.FindItems(context.Background(), &ItemFilter{Code: tt.wantCode}, 0, 0)
+			if err != nil || len(res.List) != 1 {
+				t.Fatalf("Can't find updated item %s: %v", tt.wantCode, err)
+			}
+			if res.List[0].Name != tt.item.Name {
+				t.Errorf("Name = %s, want %s", res.List[0].Name, tt.item.Name)
+			}
+			if tt.wantCode != tt.code {
+				res, _ = repo.FindItems(context.Background(), &ItemFilter{Code: tt.code}, 0, 0)
+				if res.Count != 0 {
+					t.Errorf("Item is still found by previous code %s", tt.code)
+				}
+			}
+			for category, wantCodes := range tt.wantCategory {
+				res, _ = repo.FindItems(context.Background(), &ItemFilter{Category: category}, 0, 0)
+				if len(res.List) != len(wantCodes) {
+					t.Fatalf("Got %d items of category %s, want %v", len(res.List), category, wantCodes)
+				}
+				for i, item := range res.List {
+					if item.Code != wantCodes[i] {
+						t.Errorf("Item %d of category %s has code %s, want %s", i, category, item.Code, wantCodes[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBoltItemRepositoryRemoveItem(t *testing.T) {
+	repo := newTestBoltItemRepository(t)
+	for _, tt := range []struct {
+		code        string
+		wantRemoved int64
+	}{
+		{code: "3", wantRemoved: 1},
+		{code: "3", wantRemoved: 0},
+		{code: "6", wantRemoved: 0},
+	} {
+		removed, err := repo.RemoveItem(context.Background(), tt.code)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if removed != tt.wantRemoved {
+			t.Errorf("Removed %d items with code %s, want %d", removed, tt.code, tt.wantRemoved)
+		}
+	}
+	res, _ := repo.FindItems(context.Background(), &ItemFilter{Category: "a"}, 0, 0)
+	if res.Count != 2 {
+		t.Errorf("Count of category = %d after removal, want 2", res.Count)
+	}
+}
+
+func TestBoltAuthRepositories(t *testing.T) {
+	repos, err := openTestBoltStore(t).Auth(&AuthRetention{Attempts: time.Hour})
+	if err != nil {
+		t.Fatalf("Can't create auth collections: %s", err.Error())
+	}
+	testAuthRepositories(t, repos)
+}
+
+func TestBoltAuthRepositoriesPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.db")
+	for _, add := range []bool{true, false} {
+		store, err := OpenBoltStore(path)
+		if err != nil {
+			t.Fatalf("Can't open embedded storage: %s", err.Error())
+		}
+		repos, err := store.Auth(&AuthRetention{})
+		if err != nil {
+			t.Fatalf("Can't create auth collections: %s", err.Error())
+		}
+		if add {
+			err = repos.Users.AddNewUser(context.Background(), &ShopUser{Email: "alice@example.com", Roles: []string{RoleViewer}})
+		} else {
+			var user *ShopUser
+			user, err = repos.Users.FindUser(context.Background(), "alice@example.com")
+			if err == nil && (user == nil || len(user.Roles) != 1) {
+				t.Errorf("Got user %+v after reopening, want viewer", user)
+			}
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		store.Close()
+	}
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	mgo "go.mongodb.org/mongo-driver/mongo"
+)
+
+// OAuthClient is a client registered to use OAuth2 token endpoint. Roles are
+// granted to tokens issued to the client itself by client_credentials grant.
+// Resource servers are clients allowed to introspect tokens.
+type OAuthClient struct {
+	ID            string    `bson:"client_id" json:"client_id"`
+	Name          string    `bson:"name" json:"name"`
+	SecretHash    string    `bson:"secret_hash" json:"-"`
+	GrantTypes    []string  `bson:"grant_types" json:"grant_types"`
+	Roles         []string  `bson:"roles" json:"roles"`
+	CanIntrospect bool      `bson:"can_introspect" json:"can_introspect"`
+	CreatedAt     time.Time `bson:"created_at" json:"created_at"`
+}
+
+func AddOAuthClient(ctx context.Context, client *mgo.Client, oauthClient *OAuthClient) (err error) {
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getClientsCollection(client)
+	insertRes, err := collection.InsertOne(ctx, oauthClient)
+	if err != nil {
+		return err
+	}
+	log.Printf("Inserted doc id: %s", insertRes.InsertedID)
+	return nil
+}
+
+func FindOAuthClient(ctx context.Context, client *mgo.Client, filter *bson.D) (found *OAuthClient, err error) {
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getClientsCollection(client)
+	var res OAuthClient
+	err = collection.FindOne(ctx, filter).Decode(&res)
+	if err == mgo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func UpdateOAuthClient(ctx context.Context, client *mgo.Client, filter *bson.D, update *bson.D) (matched int64, err error) {
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getClientsCollection(client)
+	updateRes, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Matched count: %d\n", updateRes.MatchedCount)
+	return updateRes.MatchedCount, nil
+}
@@ -1,15 +1,10 @@
 package db
 
 import (
-	"context"
-	"net/http"
 	"os"
-	"time"
 
-	"github.com/DenisAltruist/distsys/utils"
 	"go.mongodb.org/mongo-driver/bson"
 	mgo "go.mongodb.org/mongo-driver/mongo"
-	mgopts "go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func ToBsonDoc(v interface{}) (doc *bson.D, err error) {
@@ -21,26 +16,6 @@ func ToBsonDoc(v interface{}) (doc *bson.D, err error) {
 	return
 }
 
-func CreateSession(connStr string, timeout time.Duration) (*mgo.Client, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-	client, err := mgo.Connect(ctx, mgopts.Client().ApplyURI(connStr))
-	if err != nil {
-		return nil, err
-	}
-	return client, nil
-}
-
-func GetDbClient(w http.ResponseWriter) (*mgo.Client, bool) {
-	mongoConnStr := os.Getenv("MONGO_CONN_STRING")
-	client, err := CreateSession(mongoConnStr, 10*time.Second)
-	if err != nil {
-		utils.SendError(w, http.StatusBadRequest, "Can't connect to database, got an error: %s", err.Error())
-		return nil, false
-	}
-	return client, true
-}
-
 func getItemsCollection(client *mgo.Client) *mgo.Collection {
 	return client.Database(os.Getenv("MONGO_SHOP_DB_NAME")).Collection(os.Getenv("MONGO_ITEMS_COLL_NAME"))
 }
@@ -48,3 +23,31 @@ func getItemsCollection(client *mgo.Client) *mgo.Collection {
 func getUsersCollection(client *mgo.Client) *mgo.Collection {
 	return client.Database(os.Getenv("MONGO_SHOP_DB_NAME")).Collection(os.Getenv("MONGO_USERS_COLL_NAME"))
 }
+
+func getTokensCollection(client *mgo.Client) *mgo.Collection {
+	return client.Database(os.Getenv("MONGO_SHOP_DB_NAME")).Collection(os.Getenv("MONGO_TOKENS_COLL_NAME"))
+}
+
+func getRevocationsCollection(client *mgo.Client) *mgo.Collection {
+	return client.Database(os.Getenv("MONGO_SHOP_DB_NAME")).Collection(os.Getenv("MONGO_REVOCATIONS_COLL_NAME"))
+}
+
+func getAttemptsCollection(client *mgo.Client) *mgo.Collection {
+	return client.Database(os.Getenv("MONGO_SHOP_DB_NAME")).Collection(os.Getenv("MONGO_ATTEMPTS_COLL_NAME"))
+}
+
+func getAPIKeysCollection(client *mgo.Client) *mgo.Collection {
+	return client.Database(os.Getenv("MONGO_SHOP_DB_NAME")).Collection(os.Getenv("MONGO_API_KEYS_COLL_NAME"))
+}
+
+func getClientsCollection(client *mgo.Client) *mgo.Collection {
+	return client.Database(os.Getenv("MONGO_SHOP_DB_NAME")).Collection(os.Getenv("MONGO_CLIENTS_COLL_NAME"))
+}
+
+func getSessionsCollection(client *mgo.Client) *mgo.Collection {
+	return client.Database(os.Getenv("MONGO_SHOP_DB_NAME")).Collection(os.Getenv("MONGO_SESSIONS_COLL_NAME"))
+}
+
+func getAuditCollection(client *mgo.Client) *mgo.Collection {
+	return client.Database(os.Getenv("MONGO_SHOP_DB_NAME")).Collection(os.Getenv("MONGO_AUDIT_COLL_NAME"))
+}
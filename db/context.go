@@ -0,0 +1,105 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// StatusClientClosedRequest is the non-standard status of nginx for requests canceled by client
+const StatusClientClosedRequest = 499
+
+var (
+	// ErrCanceled is returned when the request has been canceled, usually by disconnected client
+	ErrCanceled = errors.New("Operation is canceled")
+	// ErrTimeout is returned when either the operation timeout or the request deadline is exceeded
+	ErrTimeout = errors.New("Operation timed out")
+)
+
+// Timeouts bound single operations of each kind, they are applied on top of
+// the deadline of the request context
+type Timeouts struct {
+	Read  time.Duration
+	Write time.Duration
+	Index time.Duration
+}
+
+var timeouts = Timeouts{
+	Read:  5 * time.Second,
+	Write: 5 * time.Second,
+	Index: 30 * time.Second,
+}
+
+// LoadTimeouts reads MONGO_READ_TIMEOUT_MS, MONGO_WRITE_TIMEOUT_MS and
+// MONGO_INDEX_TIMEOUT_MS, unset variables keep the defaults
+func LoadTimeouts() (*Timeouts, error) {
+	config := timeouts
+	for name, value := range map[string]*time.Duration{
+		"MONGO_READ_TIMEOUT_MS":  &config.Read,
+		"MONGO_WRITE_TIMEOUT_MS": &config.Write,
+		"MONGO_INDEX_TIMEOUT_MS": &config.Index,
+	} {
+		str := os.Getenv(name)
+		if len(str) == 0 {
+			continue
+		}
+		ms, err := strconv.Atoi(str)
+		if err != nil || ms <= 0 {
+			return nil, fmt.Errorf("Can't parse %s: expected positive number", name)
+		}
+		*value = time.Duration(ms) * time.Millisecond
+	}
+	return &config, nil
+}
+
+// SetTimeouts is meant to be called once at startup, before requests are served
+func SetTimeouts(config *Timeouts) {
+	timeouts = *config
+}
+
+func withReadTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, timeouts.Read)
+}
+
+func withWriteTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, timeouts.Write)
+}
+
+func withIndexTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, timeouts.Index)
+}
+
+// checkContext replaces error of the operation by ErrCanceled or ErrTimeout
+// when it's caused by the context, it must be deferred after cancel
+func checkContext(ctx context.Context, err *error) {
+	if *err == nil {
+		return
+	}
+	switch ctx.Err() {
+	case context.Canceled:
+		*err = ErrCanceled
+	case context.DeadlineExceeded:
+		*err = ErrTimeout
+	}
+}
+
+// IsContextError tells whether the operation has been interrupted by its context
+func IsContextError(err error) bool {
+	return err == ErrCanceled || err == ErrTimeout
+}
+
+// ErrorStatus is the response status for the error of db operation
+func ErrorStatus(err error) int {
+	switch err {
+	case ErrCanceled:
+		return StatusClientClosedRequest
+	case ErrTimeout:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
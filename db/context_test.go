@@ -0,0 +1,61 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCheckContext(t *testing.T) {
+	opErr := errors.New("Connection reset")
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		err     error
+		wantErr error
+	}{
+		{name: "no error", ctx: context.Background(), err: nil, wantErr: nil},
+		{name: "no error of canceled operation", ctx: canceled, err: nil, wantErr: nil},
+		{name: "error of live context", ctx: context.Background(), err: opErr, wantErr: opErr},
+		{name: "canceled", ctx: canceled, err: opErr, wantErr: ErrCanceled},
+		{name: "timed out", ctx: expired, err: opErr, wantErr: ErrTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.err
+			checkContext(tt.ctx, &err)
+			if err != tt.wantErr {
+				t.Errorf("Got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err         error
+		wantStatus  int
+		wantContext bool
+	}{
+		{err: ErrCanceled, wantStatus: StatusClientClosedRequest, wantContext: true},
+		{err: ErrTimeout, wantStatus: http.StatusGatewayTimeout, wantContext: true},
+		{err: ErrDuplicateKey, wantStatus: http.StatusInternalServerError},
+		{err: errors.New("Connection reset"), wantStatus: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			if status := ErrorStatus(tt.err); status != tt.wantStatus {
+				t.Errorf("ErrorStatus = %d, want %d", status, tt.wantStatus)
+			}
+			if IsContextError(tt.err) != tt.wantContext {
+				t.Errorf("IsContextError = %t, want %t", !tt.wantContext, tt.wantContext)
+			}
+		})
+	}
+}
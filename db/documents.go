@@ -0,0 +1,679 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Embedded storages keep documents of auth collections as bson and evaluate the
+// subset of mongo queries used by the services themselves, so that handlers
+// build the same filters and updates whatever storage is used. Every operation
+// scans the whole collection, which is fine for development and small deployments.
+
+// collectionSchema is what mongo indexes do for the collection
+type collectionSchema struct {
+	unique []string
+	// documents are removed expireAfter past the time in expireField, as by TTL index
+	expireField string
+	expireAfter time.Duration
+}
+
+type storedDocument struct {
+	// key of the document in the embedded storage, nil for not stored yet
+	key     []byte
+	doc     bson.M
+	changed bool
+	removed bool
+}
+
+// documentSet is the state of the collection within a single operation.
+// Documents are never modified in place, so that failed operation leaves the
+// collection as is
+type documentSet struct {
+	schema *collectionSchema
+	docs   []*storedDocument
+}
+
+// documentCollection runs operations on documents of the collection, changes
+// are stored only if write is set and fn succeeds
+type documentCollection interface {
+	transact(write bool, fn func(set *documentSet) error) error
+}
+
+// findOptions sort documents by sortKey, zero limit means no limit as in mongo
+type findOptions struct {
+	sortKey  string
+	sortDesc bool
+	offset   int64
+	limit    int64
+}
+
+func newDocumentSet(schema *collectionSchema, docs []*storedDocument) *documentSet {
+	set := &documentSet{schema: schema, docs: docs}
+	if len(schema.expireField) == 0 {
+		return set
+	}
+	now := primitive.NewDateTimeFromTime(time.Now().Add(-schema.expireAfter))
+	for _, stored := range docs {
+		if expiresAt, ok := stored.doc[schema.expireField].(primitive.DateTime); ok && expiresAt <= now {
+			stored.removed = true
+			stored.changed = true
+		}
+	}
+	return set
+}
+
+// toDocument converts value to the form it has after a roundtrip through mongo
+func toDocument(value interface{}) (bson.M, error) {
+	data, err := bson.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.M
+	err = bson.Unmarshal(data, &doc)
+	return doc, err
+}
+
+// toQuery converts filter or update keeping order of its fields
+func toQuery(value interface{}) (bson.D, error) {
+	if query, ok := value.(*bson.D); value == nil || ok && (query == nil || *query == nil) {
+		return bson.D{}, nil
+	}
+	data, err := bson.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var query bson.D
+	err = bson.Unmarshal(data, &query)
+	return query, err
+}
+
+func decodeDocument(doc bson.M, value interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, value)
+}
+
+func (set *documentSet) find(filter bson.D) ([]*storedDocument, error) {
+	var found []*storedDocument
+	for _, stored := range set.docs {
+		if stored.removed {
+			continue
+		}
+		ok, err := matchDocument(stored.doc, filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			found = append(found, stored)
+		}
+	}
+	return found, nil
+}
+
+// checkUnique returns ErrDuplicateKey if doc has the same unique field as another document
+func (set *documentSet) checkUnique(doc bson.M, self *storedDocument) error {
+	for _, key := range set.schema.unique {
+		for _, stored := range set.docs {
+			if stored == self || stored.removed {
+				continue
+			}
+			if compareValues(stored.doc[key], doc[key]) == 0 {
+				return ErrDuplicateKey
+			}
+		}
+	}
+	return nil
+}
+
+func (set *documentSet) insert(doc bson.M) error {
+	err := set.checkUnique(doc, nil)
+	if err != nil {
+		return err
+	}
+	set.docs = append(set.docs, &storedDocument{doc: doc, changed: true})
+	return nil
+}
+
+func (set *documentSet) replace(stored *storedDocument, doc bson.M) error {
+	err := set.checkUnique(doc, stored)
+	if err != nil {
+		return err
+	}
+	stored.doc = doc
+	stored.changed = true
+	return nil
+}
+
+func (set *documentSet) remove(stored *storedDocument) {
+	stored.removed = true
+	stored.changed = true
+}
+
+func insertDocument(c documentCollection, value interface{}) error {
+	doc, err := toDocument(value)
+	if err != nil {
+		return err
+	}
+	return c.transact(true, func(set *documentSet) error {
+		return set.insert(doc)
+	})
+}
+
+// findDocuments returns page of documents matching the filter and count of all of them
+func findDocuments(c documentCollection, filter interface{}, opts findOptions) (docs []bson.M, count int64, err error) {
+	query, err := toQuery(filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = c.transact(false, func(set *documentSet) error {
+		found, err := set.find(query)
+		if err != nil {
+			return err
+		}
+		for _, stored := range found {
+			docs = append(docs, stored.doc)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(opts.sortKey) != 0 {
+		sort.SliceStable(docs, func(i, j int) bool {
+			cmp := compareValues(docs[i][opts.sortKey], docs[j][opts.sortKey])
+			if opts.sortDesc {
+				return cmp > 0
+			}
+			return cmp < 0
+		})
+	}
+	count = int64(len(docs))
+	if opts.offset >= count {
+		return nil, count, nil
+	}
+	docs = docs[opts.offset:]
+	if opts.limit != 0 && opts.limit < int64(len(docs)) {
+		docs = docs[:opts.limit]
+	}
+	return docs, count, nil
+}
+
+// findDocument returns nil if no document matches the filter
+func findDocument(c documentCollection, filter interface{}) (bson.M, error) {
+	docs, _, err := findDocuments(c, filter, findOptions{limit: 1})
+	if err != nil || len(docs) == 0 {
+		return nil, err
+	}
+	return docs[0], nil
+}
+
+// updateDocuments applies update to the first matching document or to all of them
+func updateDocuments(c documentCollection, filter interface{}, update interface{}, many bool) (matched int64, err error) {
+	query, err := toQuery(filter)
+	if err != nil {
+		return 0, err
+	}
+	changes, err := toQuery(update)
+	if err != nil {
+		return 0, err
+	}
+	err = c.transact(true, func(set *documentSet) error {
+		matched = 0
+		found, err := set.find(query)
+		if err != nil {
+			return err
+		}
+		for _, stored := range found {
+			updated, err := applyUpdate(stored.doc, changes)
+			if err != nil {
+				return err
+			}
+			err = set.replace(stored, updated)
+			if err != nil {
+				return err
+			}
+			matched++
+			if !many {
+				break
+			}
+		}
+		return nil
+	})
+	return matched, err
+}
+
+// upsertDocument applies update to the first matching document or inserts the
+// document of filter fields with update applied. The document before the update
+// is returned, nil if it's inserted
+func upsertDocument(c documentCollection, filter interface{}, update interface{}) (before bson.M, err error) {
+	query, err := toQuery(filter)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := toQuery(update)
+	if err != nil {
+		return nil, err
+	}
+	err = c.transact(true, func(set *documentSet) error {
+		found, err := set.find(query)
+		if err != nil {
+			return err
+		}
+		if len(found) != 0 {
+			before = found[0].doc
+			updated, err := applyUpdate(before, changes)
+			if err != nil {
+				return err
+			}
+			return set.replace(found[0], updated)
+		}
+		before = nil
+		doc := bson.M{}
+		for _, elem := range query {
+			if !strings.HasPrefix(elem.Key, "$") && !isOperatorDocument(elem.Value) {
+				doc[elem.Key] = elem.Value
+			}
+		}
+		inserted, err := applyUpdate(doc, changes)
+		if err != nil {
+			return err
+		}
+		return set.insert(inserted)
+	})
+	return before, err
+}
+
+func removeDocuments(c documentCollection, filter interface{}, many bool) (removed int64, err error) {
+	query, err := toQuery(filter)
+	if err != nil {
+		return 0, err
+	}
+	err = c.transact(true, func(set *documentSet) error {
+		removed = 0
+		found, err := set.find(query)
+		if err != nil {
+			return err
+		}
+		for _, stored := range found {
+			set.remove(stored)
+			removed++
+			if !many {
+				break
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func isOperatorDocument(value interface{}) bool {
+	query, ok := value.(bson.D)
+	return ok && len(query) != 0 && strings.HasPrefix(query[0].Key, "$")
+}
+
+func matchDocument(doc bson.M, filter bson.D) (bool, error) {
+	for _, elem := range filter {
+		var ok bool
+		var err error
+		switch elem.Key {
+		case "$or":
+			ok, err = matchAny(doc, elem.Value)
+		case "$and":
+			ok, err = matchAll(doc, elem.Value)
+		default:
+			value, exists := doc[elem.Key]
+			ok, err = matchField(value, exists, elem.Value)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func getSubfilters(value interface{}) ([]bson.D, error) {
+	array, ok := value.(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("Expected array of filters, got %v", value)
+	}
+	filters := make([]bson.D, 0, len(array))
+	for _, item := range array {
+		filter, ok := item.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("Expected filter, got %v", item)
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+func matchAny(doc bson.M, value interface{}) (bool, error) {
+	filters, err := getSubfilters(value)
+	if err != nil {
+		return false, err
+	}
+	for _, filter := range filters {
+		ok, err := matchDocument(doc, filter)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func matchAll(doc bson.M, value interface{}) (bool, error) {
+	filters, err := getSubfilters(value)
+	if err != nil {
+		return false, err
+	}
+	for _, filter := range filters {
+		ok, err := matchDocument(doc, filter)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// equalsField is equality of mongo, arrays match values of their elements and
+// missing fields match null
+func equalsField(value interface{}, exists bool, want interface{}) bool {
+	if !exists {
+		return want == nil
+	}
+	if compareValues(value, want) == 0 {
+		return true
+	}
+	if array, ok := value.(bson.A); ok {
+		for _, item := range array {
+			if compareValues(item, want) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// orderField compares the field by $lt, $lte, $gt and $gte, only values of the same type are ordered
+func orderField(value interface{}, exists bool, want interface{}, fits func(cmp int) bool) bool {
+	if !exists || valueKind(value) != valueKind(want) {
+		return false
+	}
+	return fits(compareValues(value, want))
+}
+
+// matchRegex supports i, m and s options, which are the same in mongo and go
+func matchRegex(value interface{}, exists bool, pattern string, options string) (bool, error) {
+	flags := ""
+	for _, option := range options {
+		if !strings.ContainsRune("ims", option) {
+			return false, fmt.Errorf("Regex option %c is not supported by embedded storage", option)
+		}
+		flags += string(option)
+	}
+	if len(flags) != 0 {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, err
+	}
+	str, isString := value.(string)
+	return exists && isString && re.MatchString(str), nil
+}
+
+func matchField(value interface{}, exists bool, condition interface{}) (bool, error) {
+	if regex, ok := condition.(primitive.Regex); ok {
+		return matchRegex(value, exists, regex.Pattern, regex.Options)
+	}
+	if !isOperatorDocument(condition) {
+		return equalsField(value, exists, condition), nil
+	}
+	for _, op := range condition.(bson.D) {
+		var ok bool
+		switch op.Key {
+		case "$eq":
+			ok = equalsField(value, exists, op.Value)
+		case "$ne":
+			ok = !equalsField(value, exists, op.Value)
+		case "$lt":
+			ok = orderField(value, exists, op.Value, func(cmp int) bool { return cmp < 0 })
+		case "$lte":
+			ok = orderField(value, exists, op.Value, func(cmp int) bool { return cmp <= 0 })
+		case "$gt":
+			ok = orderField(value, exists, op.Value, func(cmp int) bool { return cmp > 0 })
+		case "$gte":
+			ok = orderField(value, exists, op.Value, func(cmp int) bool { return cmp >= 0 })
+		case "$exists":
+			want, _ := op.Value.(bool)
+			ok = exists == want
+		case "$in", "$nin":
+			array, isArray := op.Value.(bson.A)
+			if !isArray {
+				return false, fmt.Errorf("Expected array for %s, got %v", op.Key, op.Value)
+			}
+			for _, item := range array {
+				if equalsField(value, exists, item) {
+					ok = true
+					break
+				}
+			}
+			if op.Key == "$nin" {
+				ok = !ok
+			}
+		case "$regex":
+			pattern, isString := op.Value.(string)
+			if !isString {
+				return false, fmt.Errorf("Expected string for $regex, got %v", op.Value)
+			}
+			var err error
+			ok, err = matchRegex(value, exists, pattern, "")
+			if err != nil {
+				return false, err
+			}
+		default:
+			return false, fmt.Errorf("Operator %s is not supported by embedded storage", op.Key)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func getUpdateFields(value interface{}) (bson.D, error) {
+	fields, ok := value.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("Expected document of fields, got %v", value)
+	}
+	return fields, nil
+}
+
+// applyUpdate returns copy of the document with update operators applied
+func applyUpdate(doc bson.M, update bson.D) (bson.M, error) {
+	updated := make(bson.M, len(doc))
+	for key, value := range doc {
+		updated[key] = value
+	}
+	for _, op := range update {
+		fields, err := getUpdateFields(op.Value)
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range fields {
+			switch op.Key {
+			case "$set":
+				updated[field.Key] = field.Value
+			case "$unset":
+				delete(updated, field.Key)
+			case "$inc":
+				sum, err := addNumbers(updated[field.Key], field.Value)
+				if err != nil {
+					return nil, err
+				}
+				updated[field.Key] = sum
+			case "$addToSet", "$push", "$pull":
+				array, _ := updated[field.Key].(bson.A)
+				result := bson.A{}
+				found := false
+				for _, item := range array {
+					if compareValues(item, field.Value) == 0 {
+						found = true
+						if op.Key == "$pull" {
+							continue
+						}
+					}
+					result = append(result, item)
+				}
+				if op.Key == "$push" || (op.Key == "$addToSet" && !found) {
+					result = append(result, field.Value)
+				}
+				updated[field.Key] = result
+			default:
+				return nil, fmt.Errorf("Operator %s is not supported by embedded storage", op.Key)
+			}
+		}
+	}
+	return updated, nil
+}
+
+func addNumbers(value interface{}, inc interface{}) (interface{}, error) {
+	if value == nil {
+		value = int32(0)
+	}
+	if valueKind(value) != "number" || valueKind(inc) != "number" {
+		return nil, fmt.Errorf("Can't increment %v by %v", value, inc)
+	}
+	_, valueIsFloat := value.(float64)
+	_, incIsFloat := inc.(float64)
+	if valueIsFloat || incIsFloat {
+		return toFloat(value) + toFloat(inc), nil
+	}
+	return toInt(value) + toInt(inc), nil
+}
+
+func toFloat(value interface{}) float64 {
+	switch number := value.(type) {
+	case int32:
+		return float64(number)
+	case int64:
+		return float64(number)
+	case float64:
+		return number
+	}
+	return 0
+}
+
+func toInt(value interface{}) int64 {
+	switch number := value.(type) {
+	case int32:
+		return int64(number)
+	case int64:
+		return number
+	case float64:
+		return int64(number)
+	}
+	return 0
+}
+
+// valueKind groups types which are compared with each other
+func valueKind(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case int32, int64, float64:
+		return "number"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case primitive.DateTime:
+		return "date"
+	case bson.A:
+		return "array"
+	case bson.M, bson.D:
+		return "document"
+	case primitive.Binary:
+		return "binary"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// compareValues orders values of the same kind, values of different kinds are
+// ordered by kind, so that they are never equal
+func compareValues(a interface{}, b interface{}) int {
+	kindA, kindB := valueKind(a), valueKind(b)
+	if kindA != kindB {
+		return strings.Compare(kindA, kindB)
+	}
+	switch kindA {
+	case "null":
+		return 0
+	case "number":
+		_, aIsFloat := a.(float64)
+		_, bIsFloat := b.(float64)
+		if aIsFloat || bIsFloat {
+			return compareFloats(toFloat(a), toFloat(b))
+		}
+		return compareInts(toInt(a), toInt(b))
+	case "string":
+		return strings.Compare(a.(string), b.(string))
+	case "bool":
+		return compareInts(boolToInt(a.(bool)), boolToInt(b.(bool)))
+	case "date":
+		return compareInts(int64(a.(primitive.DateTime)), int64(b.(primitive.DateTime)))
+	case "array":
+		arrayA, arrayB := a.(bson.A), b.(bson.A)
+		for i := 0; i < len(arrayA) && i < len(arrayB); i++ {
+			if cmp := compareValues(arrayA[i], arrayB[i]); cmp != 0 {
+				return cmp
+			}
+		}
+		return compareInts(int64(len(arrayA)), int64(len(arrayB)))
+	default:
+		dataA, errA := bson.Marshal(bson.M{"v": a})
+		dataB, errB := bson.Marshal(bson.M{"v": b})
+		if errA != nil || errB != nil {
+			return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+		}
+		return bytes.Compare(dataA, dataB)
+	}
+}
+
+func compareInts(a int64, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareFloats(a float64, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolToInt(value bool) int64 {
+	if value {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,166 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	mgo "go.mongodb.org/mongo-driver/mongo"
+	mgopts "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func ensureUniqueIndex(ctx context.Context, collection *mgo.Collection, key string) (err error) {
+	ctx, cancel := withIndexTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	name, err := collection.Indexes().CreateOne(ctx, mgo.IndexModel{
+		Keys:    bson.D{bson.E{Key: key, Value: 1}},
+		Options: mgopts.Index().SetUnique(true),
+	})
+	if IsDuplicateKeyError(err) {
+		return fmt.Errorf("Collection %s has documents with the same %s, remove or merge them by hand and restart: %s",
+			collection.Name(), key, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Ensured index %s of %s\n", name, collection.Name())
+	return nil
+}
+
+// removeDuplicates keeps one of documents with the same key, it's used before
+// building unique index of documents which are equivalent with the same key
+func removeDuplicates(ctx context.Context, collection *mgo.Collection, key string) (err error) {
+	ctx, cancel := withIndexTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	cur, err := collection.Aggregate(ctx, mgo.Pipeline{
+		bson.D{bson.E{Key: "$group", Value: bson.D{
+			bson.E{Key: "_id", Value: "$" + key},
+			bson.E{Key: "ids", Value: bson.D{bson.E{Key: "$push", Value: "$_id"}}},
+			bson.E{Key: "count", Value: bson.D{bson.E{Key: "$sum", Value: 1}}},
+		}}},
+		bson.D{bson.E{Key: "$match", Value: bson.D{bson.E{Key: "count", Value: bson.D{bson.E{Key: "$gt", Value: 1}}}}}},
+	})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	var duplicates bson.A
+	for cur.Next(ctx) {
+		var group struct {
+			IDs bson.A `bson:"ids"`
+		}
+		err = cur.Decode(&group)
+		if err != nil {
+			return err
+		}
+		duplicates = append(duplicates, group.IDs[1:]...)
+	}
+	if cur.Err() != nil {
+		return cur.Err()
+	}
+	if len(duplicates) == 0 {
+		return nil
+	}
+	delRes, err := collection.DeleteMany(ctx, bson.D{bson.E{Key: "_id", Value: bson.D{bson.E{Key: "$in", Value: duplicates}}}})
+	if err != nil {
+		return err
+	}
+	log.Printf("Removed %d duplicates of %s in %s\n", delRes.DeletedCount, key, collection.Name())
+	return nil
+}
+
+// ensureTTLIndex makes mongo remove documents expireAfter past the time in the
+// field, expiration of existing index is updated in place
+func ensureTTLIndex(ctx context.Context, collection *mgo.Collection, field string, expireAfter time.Duration) (err error) {
+	ctx, cancel := withIndexTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	keys := bson.D{bson.E{Key: field, Value: 1}}
+	seconds := int32(expireAfter.Seconds())
+	_, err = collection.Indexes().CreateOne(ctx, mgo.IndexModel{Keys: keys, Options: mgopts.Index().SetExpireAfterSeconds(seconds)})
+	if cmdErr, ok := err.(mgo.CommandError); ok && cmdErr.Code == indexOptionsConflictCode {
+		err = collection.Database().RunCommand(ctx, bson.D{
+			bson.E{Key: "collMod", Value: collection.Name()},
+			bson.E{Key: "index", Value: bson.D{
+				bson.E{Key: "keyPattern", Value: keys},
+				bson.E{Key: "expireAfterSeconds", Value: seconds},
+			}},
+		}).Err()
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Ensured expiration of %s in %s after %s\n", field, collection.Name(), expireAfter)
+	return nil
+}
+
+// EnsureUsersIndexes makes emails unique, they are stored in canonical form, so
+// the plain index is case-insensitive once CanonicalizeUserEmails has been run
+func EnsureUsersIndexes(ctx context.Context, client *mgo.Client) error {
+	return ensureUniqueIndex(ctx, getUsersCollection(client), "email")
+}
+
+func EnsureItemsIndexes(ctx context.Context, client *mgo.Client) error {
+	return ensureUniqueIndex(ctx, getItemsCollection(client), "code")
+}
+
+// EnsureAttemptsIndexes keeps one counter per key and removes counters not
+// updated for retention, it has to cover both attempts window and lock duration
+func EnsureAttemptsIndexes(ctx context.Context, client *mgo.Client, retention time.Duration) error {
+	collection := getAttemptsCollection(client)
+	// concurrent upserts could create several counters of the key before
+	err := removeDuplicates(ctx, collection, "key")
+	if err != nil {
+		return err
+	}
+	err = ensureUniqueIndex(ctx, collection, "key")
+	if err != nil {
+		return err
+	}
+	return ensureTTLIndex(ctx, collection, "updated_at", retention)
+}
+
+// EnsureRevocationsIndexes makes revocations unique per token and removes them
+// once the token expires by itself
+func EnsureRevocationsIndexes(ctx context.Context, client *mgo.Client) error {
+	collection := getRevocationsCollection(client)
+	// repeated sign out used to revoke the same token again
+	err := removeDuplicates(ctx, collection, "jti")
+	if err != nil {
+		return err
+	}
+	err = ensureUniqueIndex(ctx, collection, "jti")
+	if err != nil {
+		return err
+	}
+	return ensureTTLIndex(ctx, collection, "expires_at", 0)
+}
+
+// EnsureTokensIndexes makes refresh tokens unique and removes expired ones
+func EnsureTokensIndexes(ctx context.Context, client *mgo.Client) error {
+	collection := getTokensCollection(client)
+	err := ensureUniqueIndex(ctx, collection, "jti")
+	if err != nil {
+		return err
+	}
+	return ensureTTLIndex(ctx, collection, "expires_at", 0)
+}
+
+// EnsureSessionsIndexes makes sessions unique and removes expired ones
+func EnsureSessionsIndexes(ctx context.Context, client *mgo.Client) error {
+	collection := getSessionsCollection(client)
+	err := ensureUniqueIndex(ctx, collection, "session_id")
+	if err != nil {
+		return err
+	}
+	return ensureTTLIndex(ctx, collection, "expires_at", 0)
+}
+
+// IsDuplicateKeyError tells whether insert or update violated unique index
+func IsDuplicateKeyError(err error) bool {
+	return err == ErrDuplicateKey || mgo.IsDuplicateKeyError(err)
+}
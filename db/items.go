@@ -12,10 +12,23 @@ import (
 	mgopts "go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// StoreItem fields added later are missing in old documents and are read as zero values
 type StoreItem struct {
 	Name     string `bson:"name" json:"name"`
 	Code     string `bson:"code" json:"code"`
 	Category string `bson:"category" json:"category"`
+	// Price is in minor units of the currency, e.g. cents for USD
+	Price       int64  `bson:"price" json:"price"`
+	Currency    string `bson:"currency" json:"currency,omitempty"`
+	Stock       int64  `bson:"stock" json:"stock"`
+	Description string `bson:"description" json:"description,omitempty"`
+	// Values of attributes are strings, numbers or booleans
+	Attributes map[string]interface{} `bson:"attributes" json:"attributes,omitempty"`
+	Images     []string               `bson:"images" json:"images,omitempty"`
+	CreatedBy  string                 `bson:"created_by,omitempty" json:"created_by,omitempty"`
+	UpdatedBy  string                 `bson:"updated_by,omitempty" json:"updated_by,omitempty"`
+	CreatedAt  *time.Time             `bson:"created_at,omitempty" json:"created_at,omitempty"`
+	UpdatedAt  *time.Time             `bson:"updated_at,omitempty" json:"updated_at,omitempty"`
 }
 
 type StoreItemsList struct {
@@ -23,9 +36,10 @@ type StoreItemsList struct {
 	List  []*StoreItem `json:"list"`
 }
 
-func AddItem(client *mgo.Client, item *StoreItem, timeout time.Duration) error {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+func AddItem(ctx context.Context, client *mgo.Client, item *StoreItem) (err error) {
+	ctx, cancel := withWriteTimeout(ctx)
 	defer cancel()
+	defer checkContext(ctx, &err)
 	collection := getItemsCollection(client)
 	insertRes, err := collection.InsertOne(ctx, item)
 	if err != nil {
@@ -35,26 +49,11 @@ func AddItem(client *mgo.Client, item *StoreItem, timeout time.Duration) error {
 	return nil
 }
 
-func DoesItemExist(client *mgo.Client, filter *bson.D, timeout time.Duration) (bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-	collection := getItemsCollection(client)
-	cur, err := collection.Find(ctx, *filter)
-	if err != nil {
-		return false, err
-	}
-	defer cur.Close(ctx)
-	isItemFound := cur.Next(context.Background())
-	if cur.Err() != nil {
-		return false, cur.Err()
-	}
-	return isItemFound, nil
-}
-
-func FindItems(client *mgo.Client, filter *bson.M, offset int64, limit int64, timeout time.Duration) (*StoreItemsList, error) {
+func FindItems(ctx context.Context, client *mgo.Client, filter *bson.M, offset int64, limit int64) (items *StoreItemsList, err error) {
 	var result StoreItemsList
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := withReadTimeout(ctx)
 	defer cancel()
+	defer checkContext(ctx, &err)
 	collection := getItemsCollection(client)
 	cur, err := collection.Find(ctx, filter, &mgopts.FindOptions{
 		Skip:  &offset,
@@ -80,9 +79,10 @@ func FindItems(client *mgo.Client, filter *bson.M, offset int64, limit int64, ti
 	return &result, nil
 }
 
-func RemoveItem(client *mgo.Client, filter *bson.M, timeout time.Duration) (int64, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+func RemoveItem(ctx context.Context, client *mgo.Client, filter *bson.M) (removed int64, err error) {
+	ctx, cancel := withWriteTimeout(ctx)
 	defer cancel()
+	defer checkContext(ctx, &err)
 	collection := getItemsCollection(client)
 	delRes, err := collection.DeleteOne(ctx, filter)
 	if err != nil {
@@ -92,13 +92,14 @@ func RemoveItem(client *mgo.Client, filter *bson.M, timeout time.Duration) (int6
 	return delRes.DeletedCount, nil
 }
 
-func UpdateItem(client *mgo.Client, filter *bson.D, newItemVal *StoreItem, timeout time.Duration) error {
+func UpdateItem(ctx context.Context, client *mgo.Client, filter *bson.D, newItemVal *StoreItem) (err error) {
 	newItemBsonD, err := ToBsonDoc(newItemVal)
 	if err != nil {
 		return err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := withWriteTimeout(ctx)
 	defer cancel()
+	defer checkContext(ctx, &err)
 	collection := getItemsCollection(client)
 	updateRes, err := collection.UpdateOne(ctx, filter, bson.D{bson.E{Key: "$set", Value: newItemBsonD}})
 	if err != nil {
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// MemoryItemRepository keeps items in memory in order of addition, to be used
+// in tests and local development without mongo
+type MemoryItemRepository struct {
+	mu    sync.RWMutex
+	items []*StoreItem
+}
+
+func NewMemoryItemRepository() *MemoryItemRepository {
+	return &MemoryItemRepository{}
+}
+
+func (r *MemoryItemRepository) findIndex(code string) int {
+	for i, item := range r.items {
+		if item.Code == code {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *MemoryItemRepository) AddItem(ctx context.Context, item *StoreItem) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.findIndex(item.Code) != -1 {
+		return ErrDuplicateKey
+	}
+	r.items = append(r.items, copyItem(item))
+	return nil
+}
+
+func (r *MemoryItemRepository) FindItems(ctx context.Context, filter *ItemFilter, offset int64, limit int64) (*StoreItemsList, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var result StoreItemsList
+	for _, item := range r.items {
+		if !filter.matches(item) {
+			continue
+		}
+		// zero limit means no limit as in mongo
+		if result.Count >= offset && (limit == 0 || result.Count < offset+limit) {
+			result.List = append(result.List, copyItem(item))
+		}
+		result.Count++
+	}
+	return &result, nil
+}
+
+func (r *MemoryItemRepository) UpdateItem(ctx context.Context, code string, owner string, item *StoreItem) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.findIndex(code)
+	if i == -1 || (len(owner) != 0 && r.items[i].CreatedBy != owner) {
+		return fmt.Errorf("Can't match item with code %s", code)
+	}
+	updated := copyItem(item)
+	keepItemFields(updated, r.items[i])
+	if updated.Code != code && r.findIndex(updated.Code) != -1 {
+		return ErrDuplicateKey
+	}
+	r.items[i] = updated
+	return nil
+}
+
+func (r *MemoryItemRepository) RemoveItem(ctx context.Context, code string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.findIndex(code)
+	if i == -1 {
+		return 0, nil
+	}
+	r.items = append(r.items[:i], r.items[i+1:]...)
+	return 1, nil
+}
+
+// copyItem copies the item with its attributes and images, values of attributes are immutable
+func copyItem(item *StoreItem) *StoreItem {
+	copied := *item
+	if item.Attributes != nil {
+		copied.Attributes = make(map[string]interface{}, len(item.Attributes))
+		for key, value := range item.Attributes {
+			copied.Attributes[key] = value
+		}
+	}
+	copied.Images = append([]string(nil), item.Images...)
+	return &copied
+}
+
+// memoryCollection keeps documents of the collection in memory
+type memoryCollection struct {
+	mu     sync.Mutex
+	schema collectionSchema
+	docs   []*storedDocument
+}
+
+func (c *memoryCollection) transact(write bool, fn func(set *documentSet) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// operation works on copies of documents, so that failed one changes nothing
+	docs := make([]*storedDocument, 0, len(c.docs))
+	for _, stored := range c.docs {
+		copied := *stored
+		docs = append(docs, &copied)
+	}
+	set := newDocumentSet(&c.schema, docs)
+	err := fn(set)
+	if err != nil || !write {
+		return err
+	}
+	c.docs = c.docs[:0]
+	for _, stored := range set.docs {
+		if !stored.removed {
+			stored.changed = false
+			c.docs = append(c.docs, stored)
+		}
+	}
+	return nil
+}
+
+// NewMemoryAuthRepositories keeps collections of the auth service in memory, to
+// be used in tests and local development without mongo
+func NewMemoryAuthRepositories(retention *AuthRetention) *AuthRepositories {
+	collections := make(map[string]documentCollection)
+	for name, schema := range getAuthSchemas(retention) {
+		collections[name] = &memoryCollection{schema: schema}
+	}
+	return newDocumentAuthRepositories(collections)
+}
+
+// NewMemoryUserRepository keeps users in memory, to be used in tests
+func NewMemoryUserRepository() UserRepository {
+	return NewMemoryAuthRepositories(&AuthRetention{}).Users
+}
@@ -0,0 +1,197 @@
+package db
+
+import (
+	"context"
+	"testing"
+)
+
+func newTestItemRepository(t *testing.T) *MemoryItemRepository {
+	repo := NewMemoryItemRepository()
+	for _, item := range []*StoreItem{
+		{Name: "laptop", Code: "1", Category: "device", CreatedBy: "alice@example.com"},
+		{Name: "phone", Code: "2", Category: "device", CreatedBy: "bob@example.com"},
+		{Name: "book", Code: "3", Category: "paper", CreatedBy: "alice@example.com"},
+		{Name: "pen", Code: "4", Category: ""},
+	} {
+		if err := repo.AddItem(context.Background(), item); err != nil {
+			t.Fatalf("Can't add item %s: %s", item.Code, err.Error())
+		}
+	}
+	return repo
+}
+
+func TestMemoryItemRepositoryFindItems(t *testing.T) {
+	repo := newTestItemRepository(t)
+	tests := []struct {
+		name      string
+		filter    ItemFilter
+		offset    int64
+		limit     int64
+		wantCount int64
+		wantCodes []string
+	}{
+		{name: "all", wantCount: 4, wantCodes: []string{"1", "2", "3", "4"}},
+		{name: "by code", filter: ItemFilter{Code: "3"}, wantCount: 1, wantCodes: []string{"3"}},
+		{name: "unknown code", filter: ItemFilter{Code: "5"}, wantCount: 0},
+		{name: "by category", filter: ItemFilter{Category: "device"}, wantCount: 2, wantCodes: []string{"1", "2"}},
+		{name: "code and category", filter: ItemFilter{Code: "3", Category: "device"}, wantCount: 0},
+		{name: "limit", limit: 2, wantCount: 4, wantCodes: []string{"1", "2"}},
+		{name: "offset", offset: 3, wantCount: 4, wantCodes: []string{"4"}},
+		{name: "offset and limit", filter: ItemFilter{Category: "device"}, offset: 1, limit: 1, wantCount: 2, wantCodes: []string{"2"}},
+		{name: "offset past the end", offset: 10, wantCount: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := repo.FindItems(context.Background(), &tt.filter, tt.offset, tt.limit)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err.Error())
+			}
+			if res.Count != tt.wantCount {
+				t.Errorf("Count = %d, want %d", res.Count, tt.wantCount)
+			}
+			if len(res.List) != len(tt.wantCodes) {
+				t.Fatalf("Got %d items, want %v", len(res.List), tt.wantCodes)
+			}
+			for i, item := range res.List {
+				if item.Code != tt.wantCodes[i] {
+					t.Errorf("Item %d has code %s, want %s", i, item.Code, tt.wantCodes[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryItemRepositoryAddDuplicate(t *testing.T) {
+	repo := newTestItemRepository(t)
+	err := repo.AddItem(context.Background(), &StoreItem{Name: "tablet", Code: "1"})
+	if !IsDuplicateKeyError(err) {
+		t.Errorf("Got error %v, want duplicate key", err)
+	}
+}
+
+func TestMemoryItemRepositoryUpdateItem(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     string
+		owner    string
+		item     StoreItem
+		wantErr  bool
+		wantDup  bool
+		wantCode string
+	}{
+		{name: "by admin", code: "2", item: StoreItem{Name: "smartphone", Code: "2"}, wantCode: "2"},
+		{name: "by creator", code: "1", owner: "alice@example.com", item: StoreItem{Name: "notebook", Code: "1"}, wantCode: "1"},
+		{name: "by another editor", code: "2", owner: "alice@example.com", item: StoreItem{Name: "smartphone", Code: "2"}, wantErr: true},
+		{name: "item without creator", code: "4", owner: "alice@example.com", item: StoreItem{Name: "pencil", Code: "4"}, wantErr: true},
+		{name: "unknown code", code: "5", item: StoreItem{Name: "tablet", Code: "5"}, wantErr: true},
+		{name: "new code", code: "3", item: StoreItem{Name: "book", Code: "30"}, wantCode: "30"},
+		{name: "code of another item", code: "3", item: StoreItem{Name: "book", Code: "1"}, wantErr: true, wantDup: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newTestItemRepository(t)
+			err := repo.UpdateItem(context.Background(), tt.code, tt.owner, &tt.item)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Got error %v, want error: %t", err, tt.wantErr)
+			}
+			if tt.wantDup && !IsDuplicateKeyError(err) {
+				t.Errorf("Got error %v, want duplicate key", err)
+			}
+			if tt.wantErr {
+				return
+			}
+			res, err := repo.FindItems(context.Background(), &ItemFilter{Code: tt.wantCode}, 0, 0)
+			if err != nil || len(res.List) != 1 {
+				t.Fatalf("Can't find updated item %s: %v", tt.wantCode, err)
+			}
+			if res.List[0].Name != tt.item.Name {
+				t.Errorf("Name = %s, want %s", res.List[0].Name, tt.item.Name)
+			}
+			if len(res.List[0].CreatedBy) == 0 {
+				t.Errorf("Creator of the item is not kept")
+			}
+		})
+	}
+}
+
+func TestMemoryItemRepositoryRemoveItem(t *testing.T) {
+	repo := newTestItemRepository(t)
+	for _, tt := range []struct {
+		code        string
+		wantRemoved int64
+	}{
+		{code: "2", wantRemoved: 1},
+		{code: "2", wantRemoved: 0},
+		{code: "5", wantRemoved: 0},
+	} {
+		removed, err := repo.RemoveItem(context.Background(), tt.code)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if removed != tt.wantRemoved {
+			t.Errorf("Removed %d items with code %s, want %d", removed, tt.code, tt.wantRemoved)
+		}
+	}
+}
+
+func TestMemoryItemRepositoryCopiesItems(t *testing.T) {
+	repo := NewMemoryItemRepository()
+	item := &StoreItem{Code: "1", Attributes: map[string]interface{}{"color": "red"}, Images: []string{"https://example.com/1.png"}}
+	if err := repo.AddItem(context.Background(), item); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	item.Attributes["color"] = "blue"
+	item.Images[0] = "https://example.com/2.png"
+	res, _ := repo.FindItems(context.Background(), &ItemFilter{}, 0, 0)
+	res.List[0].Name = "changed"
+	stored, _ := repo.FindItems(context.Background(), &ItemFilter{}, 0, 0)
+	got := stored.List[0]
+	if got.Attributes["color"] != "red" || got.Images[0] != "https://example.com/1.png" || len(got.Name) != 0 {
+		t.Errorf("Stored item is changed through the caller's copy: %+v", got)
+	}
+}
+
+func TestMemoryUserRepository(t *testing.T) {
+	repo := NewMemoryUserRepository()
+	user := &ShopUser{Email: "alice@example.com", Roles: []string{RoleViewer}}
+	if err := repo.AddNewUser(context.Background(), user); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	user.Roles[0] = RoleAdmin
+	tests := []struct {
+		name      string
+		add       *ShopUser
+		find      string
+		wantDup   bool
+		wantFound bool
+	}{
+		{name: "existing user", find: "alice@example.com", wantFound: true},
+		{name: "unknown user", find: "bob@example.com"},
+		{name: "duplicate email", add: &ShopUser{Email: "alice@example.com"}, wantDup: true},
+		{name: "new user", add: &ShopUser{Email: "bob@example.com"}, find: "bob@example.com", wantFound: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.add != nil {
+				err := repo.AddNewUser(context.Background(), tt.add)
+				if IsDuplicateKeyError(err) != tt.wantDup {
+					t.Fatalf("Got error %v, want duplicate key: %t", err, tt.wantDup)
+				}
+			}
+			if len(tt.find) == 0 {
+				return
+			}
+			found, err := repo.FindUser(context.Background(), tt.find)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err.Error())
+			}
+			if (found != nil) != tt.wantFound {
+				t.Fatalf("Got user %+v, want found: %t", found, tt.wantFound)
+			}
+		})
+	}
+	found, _ := repo.FindUser(context.Background(), "alice@example.com")
+	if found.Roles[0] != RoleViewer {
+		t.Errorf("Stored user is changed through the caller's copy: %+v", found)
+	}
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	mgo "go.mongodb.org/mongo-driver/mongo"
+)
+
+// CanonicalEmail is the form emails are stored and looked up in, so that
+// addresses differing in case only belong to the same account
+func CanonicalEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// CanonicalizeUserEmails brings emails of users created before they had
+// canonical form to it, together with emails of their tokens, sessions and API
+// keys. Users whose canonical email is taken by another user are left as is and
+// returned as conflicts, they have to be merged or removed by hand
+func CanonicalizeUserEmails(ctx context.Context, client *mgo.Client) (migrated int, conflicts []string, err error) {
+	users := getUsersCollection(client)
+	legacyEmails, err := findLegacyEmails(ctx, users)
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, legacy := range legacyEmails {
+		canonical := CanonicalEmail(legacy)
+		ok, err := renameUser(ctx, users, legacy, canonical)
+		if err != nil {
+			return migrated, conflicts, err
+		}
+		if !ok {
+			conflicts = append(conflicts, legacy)
+			continue
+		}
+		for _, collection := range []*mgo.Collection{
+			getTokensCollection(client),
+			getRevocationsCollection(client),
+			getSessionsCollection(client),
+			getAPIKeysCollection(client),
+		} {
+			err = renameEmails(ctx, collection, legacy, canonical)
+			if err != nil {
+				return migrated, conflicts, err
+			}
+		}
+		log.Printf("Migrated user %s to %s\n", legacy, canonical)
+		migrated++
+	}
+	return migrated, conflicts, nil
+}
+
+// AssignDefaultRoles gives viewer role to users created before roles existed.
+// Users with empty roles assigned by admin are left as is
+func AssignDefaultRoles(ctx context.Context, client *mgo.Client) (migrated int64, err error) {
+	ctx, cancel := withIndexTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	filter := bson.D{bson.E{Key: "roles", Value: bson.D{bson.E{Key: "$exists", Value: false}}}}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "roles", Value: []string{RoleViewer}}}}}
+	updateRes, err := getUsersCollection(client).UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return updateRes.ModifiedCount, nil
+}
+
+// GrantRole adds the role to the user, false is returned if there is no such user
+func GrantRole(ctx context.Context, users UserRepository, email string, role string) (found bool, err error) {
+	update := bson.D{bson.E{Key: "$addToSet", Value: bson.D{bson.E{Key: "roles", Value: role}}}}
+	matched, err := users.UpdateUser(ctx, &bson.D{bson.E{Key: "email", Value: CanonicalEmail(email)}}, &update)
+	return matched != 0, err
+}
+
+func findLegacyEmails(ctx context.Context, users *mgo.Collection) (emails []string, err error) {
+	ctx, cancel := withIndexTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	filter := bson.D{bson.E{Key: "email", Value: bson.D{bson.E{Key: "$regex", Value: `[A-Z]|^\s|\s$`}}}}
+	cur, err := users.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var user ShopUser
+		err = cur.Decode(&user)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, user.Email)
+	}
+	return emails, cur.Err()
+}
+
+// renameUser returns false if there is another user with the canonical email
+func renameUser(ctx context.Context, users *mgo.Collection, legacy string, canonical string) (renamed bool, err error) {
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	count, err := users.CountDocuments(ctx, bson.D{bson.E{Key: "email", Value: canonical}})
+	if err != nil || count != 0 {
+		return false, err
+	}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "email", Value: canonical}}}}
+	_, err = users.UpdateOne(ctx, bson.D{bson.E{Key: "email", Value: legacy}}, update)
+	if IsDuplicateKeyError(err) { // signed up in between
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func renameEmails(ctx context.Context, collection *mgo.Collection, legacy string, canonical string) (err error) {
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "email", Value: canonical}}}}
+	_, err = collection.UpdateMany(ctx, bson.D{bson.E{Key: "email", Value: legacy}}, update)
+	return err
+}
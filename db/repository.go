@@ -0,0 +1,136 @@
+package db
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	mgo "go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrDuplicateKey is returned by repositories other than mongo on violation of uniqueness
+var ErrDuplicateKey = errors.New("Duplicate key")
+
+// ItemFilter selects items, empty fields match any value
+type ItemFilter struct {
+	Code     string
+	Category string
+}
+
+// ItemRepository stores items of the shop, codes are unique
+type ItemRepository interface {
+	AddItem(ctx context.Context, item *StoreItem) error
+	FindItems(ctx context.Context, filter *ItemFilter, offset int64, limit int64) (*StoreItemsList, error)
+	// UpdateItem replaces fields of the item with the code, empty CreatedBy, UpdatedBy and CreatedAt are kept.
+	// Not empty owner has to be the creator of the item, it's checked atomically with the update
+	UpdateItem(ctx context.Context, code string, owner string, item *StoreItem) error
+	RemoveItem(ctx context.Context, code string) (int64, error)
+}
+
+// UserRepository stores users of the shop, emails are unique. Filters and
+// updates of users are mongo queries
+type UserRepository interface {
+	AddNewUser(ctx context.Context, user *ShopUser) error
+	// FindUser returns nil if there is no user with the email
+	FindUser(ctx context.Context, email string) (*ShopUser, error)
+	// FindUserBy returns nil if no user matches the filter
+	FindUserBy(ctx context.Context, filter *bson.D) (*ShopUser, error)
+	// FindUsers returns users sorted by email
+	FindUsers(ctx context.Context, filter *bson.D, offset int64, limit int64) (*UsersList, error)
+	// UpdateUser updates the first matching user and returns the count of matched ones
+	UpdateUser(ctx context.Context, filter *bson.D, update *bson.D) (int64, error)
+	RemoveUser(ctx context.Context, filter *bson.D) (int64, error)
+}
+
+func (f *ItemFilter) toBson() bson.M {
+	filter := bson.M{}
+	if len(f.Code) != 0 {
+		filter["code"] = f.Code
+	}
+	if len(f.Category) != 0 {
+		filter["category"] = f.Category
+	}
+	return filter
+}
+
+func (f *ItemFilter) matches(item *StoreItem) bool {
+	return (len(f.Code) == 0 || f.Code == item.Code) && (len(f.Category) == 0 || f.Category == item.Category)
+}
+
+// keepItemFields fills fields of updated item omitted on update as in mongo
+func keepItemFields(updated *StoreItem, stored *StoreItem) {
+	if len(updated.CreatedBy) == 0 {
+		updated.CreatedBy = stored.CreatedBy
+	}
+	if len(updated.UpdatedBy) == 0 {
+		updated.UpdatedBy = stored.UpdatedBy
+	}
+	if updated.CreatedAt == nil {
+		updated.CreatedAt = stored.CreatedAt
+	}
+	if updated.UpdatedAt == nil {
+		updated.UpdatedAt = stored.UpdatedAt
+	}
+}
+
+type MongoItemRepository struct {
+	client *mgo.Client
+}
+
+func NewMongoItemRepository(client *mgo.Client) *MongoItemRepository {
+	return &MongoItemRepository{client: client}
+}
+
+func (r *MongoItemRepository) AddItem(ctx context.Context, item *StoreItem) error {
+	return AddItem(ctx, r.client, item)
+}
+
+func (r *MongoItemRepository) FindItems(ctx context.Context, filter *ItemFilter, offset int64, limit int64) (*StoreItemsList, error) {
+	bsonFilter := filter.toBson()
+	return FindItems(ctx, r.client, &bsonFilter, offset, limit)
+}
+
+func (r *MongoItemRepository) UpdateItem(ctx context.Context, code string, owner string, item *StoreItem) error {
+	filter := bson.D{bson.E{Key: "code", Value: code}}
+	if len(owner) != 0 {
+		filter = append(filter, bson.E{Key: "created_by", Value: owner})
+	}
+	return UpdateItem(ctx, r.client, &filter, item)
+}
+
+func (r *MongoItemRepository) RemoveItem(ctx context.Context, code string) (int64, error) {
+	return RemoveItem(ctx, r.client, &bson.M{"code": code})
+}
+
+type MongoUserRepository struct {
+	client *mgo.Client
+}
+
+func NewMongoUserRepository(client *mgo.Client) *MongoUserRepository {
+	return &MongoUserRepository{client: client}
+}
+
+func (r *MongoUserRepository) AddNewUser(ctx context.Context, user *ShopUser) error {
+	return AddNewUser(ctx, r.client, user)
+}
+
+func (r *MongoUserRepository) FindUser(ctx context.Context, email string) (*ShopUser, error) {
+	filter := bson.D{bson.E{Key: "email", Value: email}}
+	return FindUser(ctx, r.client, &filter)
+}
+
+func (r *MongoUserRepository) FindUserBy(ctx context.Context, filter *bson.D) (*ShopUser, error) {
+	return FindUser(ctx, r.client, filter)
+}
+
+func (r *MongoUserRepository) FindUsers(ctx context.Context, filter *bson.D, offset int64, limit int64) (*UsersList, error) {
+	return FindUsers(ctx, r.client, filter, offset, limit)
+}
+
+func (r *MongoUserRepository) UpdateUser(ctx context.Context, filter *bson.D, update *bson.D) (int64, error) {
+	return UpdateUser(ctx, r.client, filter, update)
+}
+
+func (r *MongoUserRepository) RemoveUser(ctx context.Context, filter *bson.D) (int64, error) {
+	return RemoveUser(ctx, r.client, filter)
+}
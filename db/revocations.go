@@ -0,0 +1,66 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	mgo "go.mongodb.org/mongo-driver/mongo"
+	mgopts "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RevokedToken marks access token as revoked until it expires by itself
+type RevokedToken struct {
+	ID        string    `bson:"jti"`
+	Email     string    `bson:"email"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+func AddRevokedTokens(ctx context.Context, client *mgo.Client, tokens []*RevokedToken) (err error) {
+	if len(tokens) == 0 {
+		return nil
+	}
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getRevocationsCollection(client)
+	docs := make([]interface{}, 0, len(tokens))
+	for _, token := range tokens {
+		docs = append(docs, token)
+	}
+	// tokens revoked before are skipped by unique index, the rest are inserted anyway
+	insertRes, err := collection.InsertMany(ctx, docs, mgopts.InsertMany().SetOrdered(false))
+	if err != nil && !onlyDuplicateKeys(err) {
+		return err
+	}
+	if insertRes != nil {
+		log.Printf("Inserted docs count: %d", len(insertRes.InsertedIDs))
+	}
+	return nil
+}
+
+func onlyDuplicateKeys(err error) bool {
+	bulkErr, ok := err.(mgo.BulkWriteException)
+	if !ok || bulkErr.WriteConcernError != nil || len(bulkErr.WriteErrors) == 0 {
+		return false
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		if !mgo.IsDuplicateKeyError(writeErr) {
+			return false
+		}
+	}
+	return true
+}
+
+func IsTokenRevoked(ctx context.Context, client *mgo.Client, filter *bson.D) (revoked bool, err error) {
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getRevocationsCollection(client)
+	count, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return false, err
+	}
+	return count != 0, nil
+}
@@ -0,0 +1,78 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	mgo "go.mongodb.org/mongo-driver/mongo"
+	mgopts "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Session is started by every sign in and lasts while its refresh token family
+// is alive, so its ID is the family ID
+type Session struct {
+	ID              string    `bson:"session_id" json:"id"`
+	Email           string    `bson:"email" json:"email"`
+	UserAgent       string    `bson:"user_agent" json:"user_agent"`
+	IP              string    `bson:"ip" json:"ip"`
+	LastIP          string    `bson:"last_ip" json:"last_ip"`
+	CreatedAt       time.Time `bson:"created_at" json:"created_at"`
+	LastRefreshedAt time.Time `bson:"last_refreshed_at" json:"last_refreshed_at"`
+	ExpiresAt       time.Time `bson:"expires_at" json:"expires_at"`
+	Revoked         bool      `bson:"revoked" json:"-"`
+	Current         bool      `bson:"-" json:"current"`
+}
+
+func AddSession(ctx context.Context, client *mgo.Client, session *Session) (err error) {
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getSessionsCollection(client)
+	insertRes, err := collection.InsertOne(ctx, session)
+	if err != nil {
+		return err
+	}
+	log.Printf("Inserted doc id: %s", insertRes.InsertedID)
+	return nil
+}
+
+func FindSessions(ctx context.Context, client *mgo.Client, filter *bson.D) (sessions []*Session, err error) {
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getSessionsCollection(client)
+	opts := mgopts.Find().SetSort(bson.D{bson.E{Key: "last_refreshed_at", Value: -1}})
+	cur, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	result := []*Session{}
+	for cur.Next(ctx) {
+		var curSession Session
+		err = cur.Decode(&curSession)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, &curSession)
+	}
+	if cur.Err() != nil {
+		return nil, cur.Err()
+	}
+	return result, nil
+}
+
+func UpdateSessions(ctx context.Context, client *mgo.Client, filter *bson.D, update *bson.D) (matched int64, err error) {
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getSessionsCollection(client)
+	updateRes, err := collection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Matched count: %d\n", updateRes.MatchedCount)
+	return updateRes.MatchedCount, nil
+}
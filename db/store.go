@@ -0,0 +1,124 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	mgo "go.mongodb.org/mongo-driver/mongo"
+	mgopts "go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// StoreConfig is read from MONGO_* variables, unset variables take defaults and
+// pool sizes of zero are left to the driver defaults
+type StoreConfig struct {
+	ConnString     string
+	MinPoolSize    uint64
+	MaxPoolSize    uint64
+	ConnectRetries int
+	RetryDelay     time.Duration
+	MaxRetryDelay  time.Duration
+	// Timeouts of operations are applied to the whole package
+	Timeouts *Timeouts
+}
+
+// Store owns the only mongo client of the service, its connection pool is
+// shared by all requests
+type Store struct {
+	client *mgo.Client
+}
+
+// Minimal delay between connection attempts, so that retries back off even if zero delay is configured
+const minRetryDelay = 100 * time.Millisecond
+
+func LoadStoreConfig() (*StoreConfig, error) {
+	config := StoreConfig{ConnString: os.Getenv("MONGO_CONN_STRING")}
+	values := map[string]int{
+		"MONGO_MIN_POOL_SIZE":          0,
+		"MONGO_MAX_POOL_SIZE":          0,
+		"MONGO_CONNECT_RETRIES":        10,
+		"MONGO_CONNECT_RETRY_DELAY_MS": 500,
+	}
+	for name := range values {
+		str := os.Getenv(name)
+		if len(str) == 0 {
+			continue
+		}
+		value, err := strconv.Atoi(str)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("Can't parse %s: expected non-negative number", name)
+		}
+		values[name] = value
+	}
+	config.MinPoolSize = uint64(values["MONGO_MIN_POOL_SIZE"])
+	config.MaxPoolSize = uint64(values["MONGO_MAX_POOL_SIZE"])
+	config.ConnectRetries = values["MONGO_CONNECT_RETRIES"]
+	config.RetryDelay = time.Duration(values["MONGO_CONNECT_RETRY_DELAY_MS"]) * time.Millisecond
+	if config.RetryDelay < minRetryDelay {
+		config.RetryDelay = minRetryDelay
+	}
+	config.MaxRetryDelay = 30 * time.Second
+	timeouts, err := LoadTimeouts()
+	if err != nil {
+		return nil, err
+	}
+	config.Timeouts = timeouts
+	return &config, nil
+}
+
+// NewStore connects to mongo and waits until it's reachable, retrying with
+// exponential backoff since mongo may start later than the service
+func NewStore(config *StoreConfig) (*Store, error) {
+	opts := mgopts.Client().ApplyURI(config.ConnString)
+	if config.MinPoolSize != 0 {
+		opts.SetMinPoolSize(config.MinPoolSize)
+	}
+	if config.MaxPoolSize != 0 {
+		opts.SetMaxPoolSize(config.MaxPoolSize)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	client, err := mgo.Connect(ctx, opts)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	delay := config.RetryDelay
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = client.Ping(ctx, readpref.Primary())
+		cancel()
+		if err == nil {
+			break
+		}
+		if attempt >= config.ConnectRetries {
+			client.Disconnect(context.Background())
+			return nil, fmt.Errorf("Mongo is not reachable after %d attempts: %s", attempt+1, err.Error())
+		}
+		log.Printf("Mongo is not reachable, retrying in %s: %s\n", delay, err.Error())
+		time.Sleep(delay)
+		delay *= 2
+		if delay > config.MaxRetryDelay {
+			delay = config.MaxRetryDelay
+		}
+	}
+	if config.Timeouts != nil {
+		SetTimeouts(config.Timeouts)
+	}
+	log.Printf("Connected to mongo\n")
+	return &Store{client: client}, nil
+}
+
+func (s *Store) Client() *mgo.Client {
+	return s.client
+}
+
+// Disconnect closes all connections of the pool, the store can't be used after that
+func (s *Store) Disconnect(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.client.Disconnect(ctx)
+}
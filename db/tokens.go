@@ -0,0 +1,94 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	mgo "go.mongodb.org/mongo-driver/mongo"
+)
+
+// RefreshTokenRecord is stored for every issued refresh token. Tokens issued by
+// consecutive refreshes share the same FamilyID.
+type RefreshTokenRecord struct {
+	ID              string    `bson:"jti"`
+	FamilyID        string    `bson:"family_id"`
+	Email           string    `bson:"email"`
+	ExpiresAt       time.Time `bson:"expires_at"`
+	AccessTokenID   string    `bson:"access_jti"`
+	AccessExpiresAt time.Time `bson:"access_expires_at"`
+	Used            bool      `bson:"used"`
+	Revoked         bool      `bson:"revoked"`
+	// ClientID and Scope are set for tokens issued to OAuth client, nil scope
+	// grants all roles of the user
+	ClientID string   `bson:"client_id,omitempty"`
+	Scope    []string `bson:"scope,omitempty"`
+}
+
+func AddRefreshToken(ctx context.Context, client *mgo.Client, token *RefreshTokenRecord) (err error) {
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getTokensCollection(client)
+	insertRes, err := collection.InsertOne(ctx, token)
+	if err != nil {
+		return err
+	}
+	log.Printf("Inserted doc id: %s", insertRes.InsertedID)
+	return nil
+}
+
+func FindRefreshToken(ctx context.Context, client *mgo.Client, filter *bson.D) (token *RefreshTokenRecord, err error) {
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getTokensCollection(client)
+	var res RefreshTokenRecord
+	err = collection.FindOne(ctx, filter).Decode(&res)
+	if err == mgo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func FindRefreshTokens(ctx context.Context, client *mgo.Client, filter *bson.D) (tokens []*RefreshTokenRecord, err error) {
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getTokensCollection(client)
+	cur, err := collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var result []*RefreshTokenRecord
+	for cur.Next(ctx) {
+		var curToken RefreshTokenRecord
+		err = cur.Decode(&curToken)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, &curToken)
+	}
+	if cur.Err() != nil {
+		return nil, cur.Err()
+	}
+	return result, nil
+}
+
+func UpdateRefreshTokens(ctx context.Context, client *mgo.Client, filter *bson.D, update *bson.D) (matched int64, err error) {
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getTokensCollection(client)
+	updateRes, err := collection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Matched count: %d\n", updateRes.MatchedCount)
+	return updateRes.MatchedCount, nil
+}
@@ -7,23 +7,63 @@ import (
 
 	"go.mongodb.org/mongo-driver/bson"
 	mgo "go.mongodb.org/mongo-driver/mongo"
+	mgopts "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	RoleAdmin  = "admin"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+// Users created before email verification have empty status and are treated as active
+const (
+	UserStatusPending = "pending"
+	UserStatusActive  = "active"
+	// Disabled users are refused to sign in by admin
+	UserStatusDisabled = "disabled"
 )
 
 type ShopUser struct {
-	Email        string `bson:"email" json:"email"`
-	Password     string `bson:"password" json:"password"`
-	PasswordHash string `bson:"password_hash" json:"password_hash"`
+	Email               string   `bson:"email" json:"email"`
+	Password            string   `bson:"password" json:"password"`
+	PasswordHash        string   `bson:"password_hash" json:"password_hash"`
+	Roles               []string `bson:"roles" json:"roles"`
+	Status              string   `bson:"status,omitempty" json:"status,omitempty"`
+	VerificationTokenID string   `bson:"verification_token_id,omitempty" json:"-"`
+	// Only SHA-256 of password reset token is stored
+	PasswordResetHash      string    `bson:"password_reset_hash,omitempty" json:"-"`
+	PasswordResetExpiresAt time.Time `bson:"password_reset_expires_at,omitempty" json:"-"`
+	// Set by admin, the user can't sign in until password is reset
+	PasswordResetRequired bool `bson:"password_reset_required,omitempty" json:"password_reset_required,omitempty"`
+	// Two-factor authentication, only SHA-256 of recovery codes is stored
+	TOTPEnabled       bool     `bson:"totp_enabled,omitempty" json:"totp_enabled,omitempty"`
+	TOTPSecret        string   `bson:"totp_secret,omitempty" json:"-"`
+	TOTPPendingSecret string   `bson:"totp_pending_secret,omitempty" json:"-"`
+	TOTPLastStep      int64    `bson:"totp_last_step,omitempty" json:"-"`
+	RecoveryCodes     []string `bson:"recovery_codes,omitempty" json:"-"`
 }
 
+type UsersList struct {
+	Count int64       `json:"count"`
+	List  []*ShopUser `json:"list"`
+}
+
+// TokensPair is also OAuth2 access token response of RFC 6749, so refresh token
+// is omitted for grants which don't issue it
 type TokensPair struct {
-	Email        string `bson:"email" json:"email"`
+	Email        string `bson:"email" json:"email,omitempty"`
 	AccessToken  string `bson:"access_token" json:"access_token"`
-	RefreshToken string `bson:"refresh_token" json:"refresh_token"`
+	RefreshToken string `bson:"refresh_token" json:"refresh_token,omitempty"`
+	TokenType    string `bson:"token_type" json:"token_type"`
+	ExpiresIn    int64  `bson:"expires_in" json:"expires_in"`
+	Scope        string `bson:"scope,omitempty" json:"scope,omitempty"`
 }
 
-func AddNewUser(client *mgo.Client, user *ShopUser, timeout time.Duration) error {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+func AddNewUser(ctx context.Context, client *mgo.Client, user *ShopUser) (err error) {
+	ctx, cancel := withWriteTimeout(ctx)
 	defer cancel()
+	defer checkContext(ctx, &err)
 	collection := getUsersCollection(client)
 	insertRes, err := collection.InsertOne(ctx, user)
 	if err != nil {
@@ -33,16 +73,17 @@ func AddNewUser(client *mgo.Client, user *ShopUser, timeout time.Duration) error
 	return nil
 }
 
-func FindUser(client *mgo.Client, filter *bson.D, timeout time.Duration) (*ShopUser, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+func FindUser(ctx context.Context, client *mgo.Client, filter *bson.D) (user *ShopUser, err error) {
+	ctx, cancel := withReadTimeout(ctx)
 	defer cancel()
+	defer checkContext(ctx, &err)
 	collection := getUsersCollection(client)
 	cur, err := collection.Find(ctx, filter)
 	if err != nil {
 		return nil, err
 	}
 	defer cur.Close(ctx)
-	isUserFound := cur.Next(context.Background())
+	isUserFound := cur.Next(ctx)
 	if cur.Err() != nil {
 		return nil, cur.Err()
 	}
@@ -53,3 +94,60 @@ func FindUser(client *mgo.Client, filter *bson.D, timeout time.Duration) (*ShopU
 	cur.Decode(&res)
 	return &res, nil
 }
+
+func FindUsers(ctx context.Context, client *mgo.Client, filter *bson.D, offset int64, limit int64) (users *UsersList, err error) {
+	var result UsersList
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getUsersCollection(client)
+	opts := mgopts.Find().SetSkip(offset).SetLimit(limit).SetSort(bson.D{bson.E{Key: "email", Value: 1}})
+	cur, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var curUser ShopUser
+		err = cur.Decode(&curUser)
+		if err != nil {
+			return nil, err
+		}
+		result.List = append(result.List, &curUser)
+	}
+	if cur.Err() != nil {
+		return nil, cur.Err()
+	}
+	numOfDocs, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	result.Count = numOfDocs
+	return &result, nil
+}
+
+func UpdateUser(ctx context.Context, client *mgo.Client, filter *bson.D, update *bson.D) (matched int64, err error) {
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getUsersCollection(client)
+	updateRes, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Matched count: %d\n", updateRes.MatchedCount)
+	return updateRes.MatchedCount, nil
+}
+
+func RemoveUser(ctx context.Context, client *mgo.Client, filter *bson.D) (removed int64, err error) {
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+	defer checkContext(ctx, &err)
+	collection := getUsersCollection(client)
+	delRes, err := collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Deleted documents count for %v: %d\n", filter, delRes.DeletedCount)
+	return delRes.DeletedCount, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// Identity of the caller verified by authMiddleware
+type Identity struct {
+	Subject string
+	Roles   []string
+	TokenID string
+}
+
+type identityKey struct{}
+
+func newIdentityFromClaims(claims jwt.MapClaims) *Identity {
+	subject, ok := claims["sub"].(string)
+	if !ok {
+		subject, _ = claims["email"].(string)
+	}
+	tokenID, _ := claims["jti"].(string)
+	return &Identity{
+		Subject: subject,
+		Roles:   getClaimRoles(claims),
+		TokenID: tokenID,
+	}
+}
+
+func (id *Identity) hasRole(role string) bool {
+	for _, curRole := range id.Roles {
+		if curRole == role {
+			return true
+		}
+	}
+	return false
+}
+
+func withIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// getIdentity returns identity of the caller, ok is false for requests which
+// passed authMiddleware without authorization
+func getIdentity(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// Unknown kid triggers refetch of key set, but not more often than this
+const minKeysRefetchInterval = 10 * time.Second
+
+type jsonWebKey struct {
+	KeyType  string `json:"kty"`
+	KeyID    string `json:"kid"`
+	Modulus  string `json:"n"`
+	Exponent string `json:"e"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// keyCache keeps public keys of the auth service fetched from its JWKS endpoint
+type keyCache struct {
+	url       string
+	ttl       time.Duration
+	client    http.Client
+	mu        sync.RWMutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+func newKeyCache(url string, ttl time.Duration) *keyCache {
+	return &keyCache{
+		url:    url,
+		ttl:    ttl,
+		client: http.Client{Timeout: 5 * time.Second},
+		keys:   make(map[string]*rsa.PublicKey),
+	}
+}
+
+func parseJSONWebKey(key *jsonWebKey) (*rsa.PublicKey, error) {
+	if key.KeyType != "RSA" {
+		return nil, fmt.Errorf("Unsupported key type: %s", key.KeyType)
+	}
+	modulus, err := base64.RawURLEncoding.DecodeString(key.Modulus)
+	if err != nil {
+		return nil, err
+	}
+	exponent, err := base64.RawURLEncoding.DecodeString(key.Exponent)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(modulus),
+		E: int(new(big.Int).SetBytes(exponent).Int64()),
+	}, nil
+}
+
+func (c *keyCache) refresh() error {
+	c.mu.Lock()
+	c.fetchedAt = time.Now()
+	c.mu.Unlock()
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Got status %d on fetching keys", resp.StatusCode)
+	}
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var keySet jsonWebKeySet
+	err = json.Unmarshal(contents, &keySet)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for i := range keySet.Keys {
+		key, err := parseJSONWebKey(&keySet.Keys[i])
+		if err != nil {
+			log.Printf("Skipping key %s: %s\n", keySet.Keys[i].KeyID, err.Error())
+			continue
+		}
+		keys[keySet.Keys[i].KeyID] = key
+	}
+	c.mu.Lock()
+	c.keys = keys
+	c.mu.Unlock()
+	log.Printf("Fetched %d keys from %s\n", len(keys), c.url)
+	return nil
+}
+
+// run refreshes keys in background every ttl
+func (c *keyCache) run() {
+	ticker := time.NewTicker(c.ttl)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := c.refresh(); err != nil {
+			log.Printf("Can't refresh keys: %s\n", err.Error())
+		}
+	}
+}
+
+func (c *keyCache) getKey(keyID string) (*rsa.PublicKey, error) {
+	c.mu.RLock()
+	key, ok := c.keys[keyID]
+	fetchedAt := c.fetchedAt
+	c.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if time.Since(fetchedAt) < minKeysRefetchInterval {
+		return nil, fmt.Errorf("Unknown key id: %s", keyID)
+	}
+	if err := c.refresh(); err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	key, ok = c.keys[keyID]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown key id: %s", keyID)
+	}
+	return key, nil
+}
+
+func (c *keyCache) verifyAccessToken(token string) (jwt.MapClaims, error) {
+	decodedToken, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		keyID, ok := token.Header["kid"].(string)
+		if !ok {
+			return nil, errors.New("Token has no kid header")
+		}
+		return c.getKey(keyID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := decodedToken.Claims.(jwt.MapClaims)
+	if !ok || !decodedToken.Valid {
+		return nil, errors.New("Can't convert jwt claims to map")
+	}
+	if tokenType, _ := claims["type"].(string); tokenType != "access" {
+		return nil, errors.New("Token is not an access token")
+	}
+	if _, ok := claims["exp"].(float64); !ok {
+		return nil, errors.New("Token has no expiration time")
+	}
+	return claims, nil
+}
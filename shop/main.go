@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -13,9 +15,13 @@ import (
 	"github.com/DenisAltruist/distsys/db"
 	"github.com/DenisAltruist/distsys/utils"
 	"github.com/gorilla/mux"
-	"go.mongodb.org/mongo-driver/bson"
 )
 
+// server holds dependencies shared by handlers
+type server struct {
+	items db.ItemRepository
+}
+
 func getItemFromRequest(w http.ResponseWriter, r *http.Request) (*db.StoreItem, bool) {
 	contents, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -28,51 +34,55 @@ func getItemFromRequest(w http.ResponseWriter, r *http.Request) (*db.StoreItem,
 		utils.SendError(w, http.StatusBadRequest, "Can't unrmashal contents %s, expected valid JSON", string(contents))
 		return nil, false
 	}
+	err = validateItem(&newItem)
+	if err != nil {
+		utils.SendError(w, http.StatusBadRequest, "Item is not valid: %s", err.Error())
+		return nil, false
+	}
 	return &newItem, true
 }
 
-func createItem(w http.ResponseWriter, r *http.Request) {
+func (s *server) createItem(w http.ResponseWriter, r *http.Request) {
 	newItem, ok := getItemFromRequest(w, r)
 	if !ok {
 		return
 	}
-	client, ok := db.GetDbClient(w)
-	if !ok {
+	if len(newItem.Code) == 0 { // items are found by code, so it can't be empty in any store
+		utils.SendError(w, http.StatusBadRequest, "'code' of the item is not specified")
 		return
 	}
-	filter := bson.D{bson.E{Key: "code", Value: newItem.Code}} // Maintenance of uniqueness of codes
-	isAlreadyAdded, err := db.DoesItemExist(client, &filter, 5*time.Second)
-	if err != nil {
-		utils.SendError(w, http.StatusInternalServerError, "Can't check if there is another item with code %s", newItem.Code)
+	identity, ok := getIdentity(r.Context())
+	if !ok {
+		utils.SendError(w, http.StatusUnauthorized, "Caller is not authenticated")
 		return
 	}
-	if isAlreadyAdded {
-		utils.SendError(w, http.StatusBadRequest, "There is another item with code %s already created", newItem.Code)
+	newItem.CreatedBy = identity.Subject
+	newItem.UpdatedBy = ""
+	now := time.Now()
+	newItem.CreatedAt = &now
+	newItem.UpdatedAt = &now
+	err := s.items.AddItem(r.Context(), newItem)
+	if db.IsDuplicateKeyError(err) { // codes are unique by index
+		utils.SendError(w, http.StatusConflict, "There is another item with code %s already created", newItem.Code)
 		return
 	}
-	err = db.AddItem(client, newItem, 5*time.Second)
 	if err != nil {
-		utils.SendError(w, http.StatusInternalServerError, "Can't add item, got an error: %s", err.Error())
+		utils.SendError(w, db.ErrorStatus(err), "Can't add item, got an error: %s", err.Error())
 		return
 	}
 	utils.SendBodyResponse(w, "Success", http.StatusOK)
 }
 
-func showItem(w http.ResponseWriter, r *http.Request) {
+func (s *server) showItem(w http.ResponseWriter, r *http.Request) {
 	filterKey := "code"
 	filterVal := r.FormValue(filterKey)
 	if len(filterVal) == 0 {
 		utils.SendError(w, http.StatusBadRequest, "'%s' argument is not specified", filterKey)
 		return
 	}
-	filter := bson.M{filterKey: filterVal}
-	client, ok := db.GetDbClient(w)
-	if !ok {
-		return
-	}
-	items, err := db.FindItems(client, &filter, 0 /* offset */, 1 /* limit */, 5*time.Second)
+	items, err := s.items.FindItems(r.Context(), &db.ItemFilter{Code: filterVal}, 0 /* offset */, 1 /* limit */)
 	if err != nil {
-		utils.SendError(w, http.StatusInternalServerError, "Can't find item with code %s, got an error: %s", filterVal, err.Error())
+		utils.SendError(w, db.ErrorStatus(err), "Can't find item with code %s, got an error: %s", filterVal, err.Error())
 		return
 	}
 	if items.Count == 0 {
@@ -89,21 +99,16 @@ func showItem(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s\n", string(encodedItem))
 }
 
-func removeItem(w http.ResponseWriter, r *http.Request) {
+func (s *server) removeItem(w http.ResponseWriter, r *http.Request) {
 	filterKey := "code"
 	filterVal := r.FormValue(filterKey)
 	if len(filterVal) == 0 {
 		utils.SendError(w, http.StatusBadRequest, "'%s' argument is not specified", filterKey)
 		return
 	}
-	filter := bson.M{filterKey: filterVal}
-	client, ok := db.GetDbClient(w)
-	if !ok {
-		return
-	}
-	removeCount, err := db.RemoveItem(client, &filter, 5*time.Second)
+	removeCount, err := s.items.RemoveItem(r.Context(), filterVal)
 	if err != nil {
-		utils.SendError(w, http.StatusInternalServerError, "Can't remove item: %s", err.Error())
+		utils.SendError(w, db.ErrorStatus(err), "Can't remove item: %s", err.Error())
 		return
 	}
 	if removeCount == 0 {
@@ -113,7 +118,7 @@ func removeItem(w http.ResponseWriter, r *http.Request) {
 	utils.SendBodyResponse(w, "Success", http.StatusOK)
 }
 
-func showItemsList(w http.ResponseWriter, r *http.Request) {
+func (s *server) showItemsList(w http.ResponseWriter, r *http.Request) {
 	filterKey := "category"
 	offsetStr := r.FormValue("offset") // pagination
 	limitStr := r.FormValue("limit")   // pagination
@@ -132,14 +137,9 @@ func showItemsList(w http.ResponseWriter, r *http.Request) {
 		utils.SendError(w, http.StatusBadRequest, "'%s' argument is not specified", filterKey)
 		return
 	}
-	filter := bson.M{filterKey: filterVal}
-	client, ok := db.GetDbClient(w)
-	if !ok {
-		return
-	}
-	items, err := db.FindItems(client, &filter, offset, limit, 5*time.Second)
+	items, err := s.items.FindItems(r.Context(), &db.ItemFilter{Category: filterVal}, offset, limit)
 	if err != nil {
-		utils.SendError(w, http.StatusBadRequest, "Can't remove item: %s", err.Error())
+		utils.SendError(w, db.ErrorStatus(err), "Can't find items, got an error: %s", err.Error())
 		return
 	}
 	log.Printf("Num of items: %d\n", items.Count)
@@ -152,24 +152,51 @@ func showItemsList(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s\n", string(encodedItems))
 }
 
-func editItem(w http.ResponseWriter, r *http.Request) {
+func (s *server) editItem(w http.ResponseWriter, r *http.Request) {
 	filterKey := "code"
 	filterVal := r.FormValue(filterKey)
 	if len(filterVal) == 0 {
 		utils.SendError(w, http.StatusBadRequest, "'%s' argument is not specified", filterKey)
 		return
 	}
-	filter := bson.D{bson.E{Key: filterKey, Value: filterVal}}
 	newItemFields, ok := getItemFromRequest(w, r)
 	if !ok {
 		return
 	}
 	newItemFields.Code = filterVal // we forbid to change code of the requested item
-	client, ok := db.GetDbClient(w)
+	identity, ok := getIdentity(r.Context())
 	if !ok {
+		utils.SendError(w, http.StatusUnauthorized, "Caller is not authenticated")
+		return
+	}
+	newItemFields.CreatedBy = "" // empty fields are omitted, so creator is kept
+	newItemFields.UpdatedBy = identity.Subject
+	now := time.Now()
+	newItemFields.CreatedAt = nil
+	newItemFields.UpdatedAt = &now
+	owner := ""
+	if !identity.hasRole(db.RoleAdmin) { // editors may change only items created by themselves
+		owner = identity.Subject
+		items, err := s.items.FindItems(r.Context(), &db.ItemFilter{Code: filterVal}, 0 /* offset */, 1 /* limit */)
+		if err != nil {
+			utils.SendError(w, db.ErrorStatus(err), "Can't find item with code %s, got an error: %s", filterVal, err.Error())
+			return
+		}
+		if items.Count == 0 {
+			utils.SendError(w, http.StatusBadRequest, "There is no item with code %s to update", filterVal)
+			return
+		}
+		if items.List[0].CreatedBy != identity.Subject {
+			utils.SendError(w, http.StatusForbidden, "Only admins can update items created by other users")
+			return
+		}
+	}
+	// the creator is checked once again by the update, since the item may be changed in between
+	err := s.items.UpdateItem(r.Context(), filterVal, owner, newItemFields)
+	if db.IsContextError(err) {
+		utils.SendError(w, db.ErrorStatus(err), "Can't update item: %s", err.Error())
 		return
 	}
-	err := db.UpdateItem(client, &filter, newItemFields, 5*time.Second)
 	if err != nil {
 		utils.SendError(w, http.StatusBadRequest, "Can't update item: %s", err.Error())
 		return
@@ -178,12 +205,74 @@ func editItem(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	storeType := flag.String("store", "mongo", "where items are stored: mongo, bolt or memory")
+	boltPath := flag.String("bolt-path", "shop.db", "file of the embedded storage for -store=bolt")
+	flag.Parse()
+	keysTTLSeconds, err := strconv.Atoi(os.Getenv("AUTH_JWKS_TTL_SECONDS"))
+	if err != nil {
+		log.Fatalf("Can't parse AUTH_JWKS_TTL_SECONDS: %s", err.Error())
+	}
+	if keysTTLSeconds <= 0 {
+		log.Fatalf("AUTH_JWKS_TTL_SECONDS should be positive, got %d", keysTTLSeconds)
+	}
+	keys := newKeyCache(os.Getenv("AUTH_JWKS_ROUTE"), time.Duration(keysTTLSeconds)*time.Second)
+	err = keys.refresh()
+	if err != nil {
+		log.Printf("Can't fetch auth keys, will retry later: %s\n", err.Error())
+	}
+	go keys.run()
+	var store *db.Store
+	var boltStore *db.BoltStore
+	s := &server{}
+	switch *storeType {
+	case "mongo":
+		storeConfig, err := db.LoadStoreConfig()
+		if err != nil {
+			log.Fatalf("Can't load database config: %s", err.Error())
+		}
+		store, err = db.NewStore(storeConfig)
+		if err != nil {
+			log.Fatalf("Can't connect to database: %s", err.Error())
+		}
+		err = db.EnsureItemsIndexes(context.Background(), store.Client())
+		if err != nil {
+			log.Fatalf("Can't create items indexes: %s", err.Error())
+		}
+		s.items = db.NewMongoItemRepository(store.Client())
+	case "bolt":
+		boltStore, err = db.OpenBoltStore(*boltPath)
+		if err != nil {
+			log.Fatalf("Can't open embedded storage %s: %s", *boltPath, err.Error())
+		}
+		s.items = boltStore.Items()
+	case "memory":
+		log.Printf("Items are kept in memory and will be lost on exit\n")
+		s.items = db.NewMemoryItemRepository()
+	default:
+		log.Fatalf("Unknown store: %s", *storeType)
+	}
 	router := mux.NewRouter()
-	router.HandleFunc("/item", createItem).Methods("POST")
-	router.HandleFunc("/item", removeItem).Methods("DELETE")
-	router.HandleFunc("/item", showItem).Methods("GET")
-	router.HandleFunc("/item", editItem).Methods("PUT")
-	router.HandleFunc("/items", showItemsList).Methods("GET")
-	router.Use(authMiddleware())
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", os.Getenv("EXTERNAL_LISTEN_PORT")), router))
+	policy := routeRoles{}
+	policy.require(router.HandleFunc("/item", s.createItem).Methods("POST"), db.RoleEditor, db.RoleAdmin)
+	policy.require(router.HandleFunc("/item", s.removeItem).Methods("DELETE"), db.RoleAdmin)
+	router.HandleFunc("/item", s.showItem).Methods("GET")
+	policy.require(router.HandleFunc("/item", s.editItem).Methods("PUT"), db.RoleEditor, db.RoleAdmin)
+	router.HandleFunc("/items", s.showItemsList).Methods("GET")
+	router.Use(authMiddleware(keys, policy))
+	err = utils.ListenAndServe(fmt.Sprintf(":%s", os.Getenv("EXTERNAL_LISTEN_PORT")), router, 10*time.Second)
+	if err != nil {
+		log.Printf("Server stopped: %s\n", err.Error())
+	}
+	if store != nil {
+		err = store.Disconnect(10 * time.Second)
+		if err != nil {
+			log.Fatalf("Can't disconnect from database: %s", err.Error())
+		}
+	}
+	if boltStore != nil {
+		err = boltStore.Close()
+		if err != nil {
+			log.Fatalf("Can't close embedded storage: %s", err.Error())
+		}
+	}
 }
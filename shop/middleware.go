@@ -4,8 +4,8 @@ import (
 	"encoding/json"
 	"errors"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -15,57 +15,127 @@ import (
 	"github.com/gorilla/mux"
 )
 
-func authMiddleware() mux.MiddlewareFunc {
+// introspectionResult is response of RFC 7662 introspection endpoint of the auth service
+type introspectionResult struct {
+	Active    bool     `json:"active"`
+	Subject   string   `json:"sub"`
+	ClientID  string   `json:"client_id"`
+	Scope     string   `json:"scope"`
+	Roles     []string `json:"roles"`
+	TokenType string   `json:"token_type"`
+	ExpiresAt int64    `json:"exp"`
+	IssuedAt  int64    `json:"iat"`
+	TokenID   string   `json:"jti"`
+}
+
+func authMiddleware(keys *keyCache, policy routeRoles) mux.MiddlewareFunc {
+	checkRevocation := os.Getenv("AUTH_REVOCATION_CHECK") == "true"
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if r.Method == "GET" { // no need to authorize GET requests
+			route := mux.CurrentRoute(r)
+			_, hasRoles := policy[route]
+			if r.Method == "GET" && !hasRoles { // no need to authorize GET requests
 				next.ServeHTTP(w, r)
 				return
 			}
-			authToken, err := getAuthToken(r)
-			if err != nil {
-				w.WriteHeader(http.StatusUnauthorized)
-				return
-			}
-			req, err := http.NewRequest("GET", os.Getenv("AUTH_VALIDATION_ROUTE"), nil)
-			if err != nil {
-				utils.SendError(w, http.StatusUnauthorized, "Can't create auth request: %s", err.Error())
-				return
-			}
-			q := req.URL.Query()
-			q.Add("token", authToken)
-			req.URL.RawQuery = q.Encode()
-			client := http.Client{
-				Timeout: 5 * time.Second,
-			}
-			resp, err := client.Do(req)
-			if err != nil {
-				utils.SendError(w, http.StatusUnauthorized, "Can't make validate GET request: %s", err.Error())
-				return
-			}
-			if resp.StatusCode == http.StatusUnauthorized {
-				w.WriteHeader(http.StatusUnauthorized)
-				return
+			var identity *Identity
+			var ok bool
+			if apiKey, hasAPIKey := getAPIKey(r); hasAPIKey {
+				identity, ok = authenticateRemotely(w, apiKey, "ApiKey")
+			} else {
+				identity, ok = authenticateBearer(w, r, keys, checkRevocation)
 			}
-			defer resp.Body.Close()
-			var respJson utils.ClientResponse
-			message, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				utils.SendError(w, http.StatusUnauthorized, "Can't read bytes from body of validation request: %s", err.Error())
+			if !ok {
 				return
 			}
-			log.Printf("%s\n", string(message))
-			err = json.Unmarshal([]byte(string(message)), &respJson)
-			if err != nil {
-				utils.SendError(w, http.StatusUnauthorized, "Can't convert bytes from body of validation request to JSON: %s", err.Error())
+			if !policy.isAllowed(route, identity.Roles) {
+				utils.SendError(w, http.StatusForbidden, "Not enough permissions to %s %s", r.Method, r.URL.Path)
 				return
 			}
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), identity)))
 			return
 		})
 	}
 }
 
+// authenticateBearer verifies access token locally, auth service is asked only
+// whether the token has been revoked if configured so
+func authenticateBearer(w http.ResponseWriter, r *http.Request, keys *keyCache, checkRevocation bool) (*Identity, bool) {
+	authToken, err := getAuthToken(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, false
+	}
+	claims, err := keys.verifyAccessToken(authToken)
+	if err != nil {
+		utils.SendError(w, http.StatusUnauthorized, "Token is expired or not correct: %s", err.Error())
+		return nil, false
+	}
+	if checkRevocation {
+		return authenticateRemotely(w, authToken, "Bearer")
+	}
+	return newIdentityFromClaims(claims), true
+}
+
+// authenticateRemotely introspects token of wantTokenType in the auth service
+func authenticateRemotely(w http.ResponseWriter, token string, wantTokenType string) (*Identity, bool) {
+	result, err := introspectToken(token)
+	if err != nil {
+		utils.SendError(w, http.StatusUnauthorized, "Can't introspect token: %s", err.Error())
+		return nil, false
+	}
+	if !result.Active || result.TokenType != wantTokenType {
+		utils.SendError(w, http.StatusUnauthorized, "Token is expired, revoked or not correct")
+		return nil, false
+	}
+	return &Identity{Subject: result.Subject, Roles: result.Roles, TokenID: result.TokenID}, true
+}
+
+func introspectToken(token string) (*introspectionResult, error) {
+	form := url.Values{}
+	form.Set("token", token)
+	req, err := http.NewRequest("POST", os.Getenv("AUTH_INTROSPECTION_ROUTE"), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(os.Getenv("AUTH_CLIENT_ID")), url.QueryEscape(os.Getenv("AUTH_CLIENT_SECRET")))
+	client := http.Client{
+		Timeout: 5 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	message, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Introspection failed: " + string(message))
+	}
+	var result introspectionResult
+	err = json.Unmarshal(message, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// getAPIKey retrieves API key of machine clients from either X-API-Key header or
+// Authorization header with ApiKey scheme
+func getAPIKey(r *http.Request) (string, bool) {
+	if apiKey := r.Header.Get("X-API-Key"); len(apiKey) != 0 {
+		return apiKey, true
+	}
+	splitAuth := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(splitAuth) == 2 && splitAuth[0] == "ApiKey" {
+		return splitAuth[1], true
+	}
+	return "", false
+}
+
 func getAuthToken(r *http.Request) (string, error) {
 	authString := r.Header.Get("Authorization")
 	splitAuth := strings.Split(authString, " ")
@@ -0,0 +1,42 @@
+package main
+
+import (
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+)
+
+// routeRoles maps routes of the router to roles allowed to call them.
+// Routes without declared roles are available to any authorized user.
+type routeRoles map[*mux.Route][]string
+
+func (rr routeRoles) require(route *mux.Route, roles ...string) *mux.Route {
+	rr[route] = roles
+	return route
+}
+
+// isAllowed reports whether any of userRoles is among roles required by route
+func (rr routeRoles) isAllowed(route *mux.Route, userRoles []string) bool {
+	requiredRoles, ok := rr[route]
+	if !ok {
+		return true
+	}
+	for _, requiredRole := range requiredRoles {
+		for _, userRole := range userRoles {
+			if userRole == requiredRole {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func getClaimRoles(claims jwt.MapClaims) []string {
+	rawRoles, _ := claims["roles"].([]interface{})
+	roles := make([]string, 0, len(rawRoles))
+	for _, rawRole := range rawRoles {
+		if role, ok := rawRole.(string); ok {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
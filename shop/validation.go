@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/DenisAltruist/distsys/db"
+)
+
+const (
+	maxDescriptionLength    = 4096
+	maxAttributesCount      = 50
+	maxAttributeKeyLength   = 64
+	maxAttributeValueLength = 1024
+	maxImagesCount          = 20
+)
+
+// Only the format of ISO 4217 codes is checked, the list of currencies changes
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// validateItem checks fields of the item sent by client, server-managed fields are ignored
+func validateItem(item *db.StoreItem) error {
+	if item.Price < 0 {
+		return fmt.Errorf("price can't be negative")
+	}
+	if len(item.Currency) == 0 && item.Price != 0 {
+		return fmt.Errorf("currency of the price is not specified")
+	}
+	if len(item.Currency) != 0 && !currencyPattern.MatchString(item.Currency) {
+		return fmt.Errorf("currency %s is not ISO 4217 code", item.Currency)
+	}
+	if item.Stock < 0 {
+		return fmt.Errorf("stock can't be negative")
+	}
+	if len(item.Description) > maxDescriptionLength {
+		return fmt.Errorf("description is longer than %d bytes", maxDescriptionLength)
+	}
+	if len(item.Attributes) > maxAttributesCount {
+		return fmt.Errorf("there are more than %d attributes", maxAttributesCount)
+	}
+	for key, value := range item.Attributes {
+		if len(key) == 0 || len(key) > maxAttributeKeyLength {
+			return fmt.Errorf("attribute name '%s' should be from 1 to %d bytes", key, maxAttributeKeyLength)
+		}
+		// mongo treats such names as paths and operators
+		if strings.Contains(key, ".") || strings.HasPrefix(key, "$") {
+			return fmt.Errorf("attribute name '%s' can't contain '.' or start with '$'", key)
+		}
+		// JSON numbers are decoded as float64
+		switch value := value.(type) {
+		case string:
+			if len(value) > maxAttributeValueLength {
+				return fmt.Errorf("attribute %s is longer than %d bytes", key, maxAttributeValueLength)
+			}
+		case float64, bool:
+		default:
+			return fmt.Errorf("attribute %s should be string, number or boolean", key)
+		}
+	}
+	if len(item.Images) > maxImagesCount {
+		return fmt.Errorf("there are more than %d images", maxImagesCount)
+	}
+	for _, image := range item.Images {
+		imageURL, err := url.Parse(image)
+		if err != nil || (imageURL.Scheme != "http" && imageURL.Scheme != "https") || len(imageURL.Host) == 0 {
+			return fmt.Errorf("image %s is not absolute HTTP(S) URL", image)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/DenisAltruist/distsys/db"
+)
+
+func TestValidateItem(t *testing.T) {
+	manyAttributes := make(map[string]interface{})
+	for i := 0; i <= maxAttributesCount; i++ {
+		manyAttributes[strings.Repeat("a", i+1)] = true
+	}
+	manyImages := make([]string, maxImagesCount+1)
+	for i := range manyImages {
+		manyImages[i] = "https://example.com/image.png"
+	}
+	tests := []struct {
+		name    string
+		item    db.StoreItem
+		wantErr bool
+	}{
+		{name: "empty", item: db.StoreItem{}},
+		{name: "full", item: db.StoreItem{
+			Price:       129900,
+			Currency:    "RUB",
+			Stock:       7,
+			Description: "14 inch laptop",
+			Attributes:  map[string]interface{}{"ram_gb": float64(16), "color": "silver", "refurbished": false},
+			Images:      []string{"https://example.com/laptop.png", "http://example.com/laptop.jpg"},
+		}},
+		{name: "negative price", item: db.StoreItem{Price: -1, Currency: "RUB"}, wantErr: true},
+		{name: "price without currency", item: db.StoreItem{Price: 100}, wantErr: true},
+		{name: "lowercase currency", item: db.StoreItem{Price: 100, Currency: "rub"}, wantErr: true},
+		{name: "long currency", item: db.StoreItem{Price: 100, Currency: "RUBL"}, wantErr: true},
+		{name: "negative stock", item: db.StoreItem{Stock: -1}, wantErr: true},
+		{name: "longest description", item: db.StoreItem{Description: strings.Repeat("a", maxDescriptionLength)}},
+		{name: "long description", item: db.StoreItem{Description: strings.Repeat("a", maxDescriptionLength+1)}, wantErr: true},
+		{name: "too many attributes", item: db.StoreItem{Attributes: manyAttributes}, wantErr: true},
+		{name: "empty attribute name", item: db.StoreItem{Attributes: map[string]interface{}{"": "a"}}, wantErr: true},
+		{name: "long attribute name", item: db.StoreItem{Attributes: map[string]interface{}{strings.Repeat("a", maxAttributeKeyLength+1): "a"}}, wantErr: true},
+		{name: "dotted attribute name", item: db.StoreItem{Attributes: map[string]interface{}{"screen.size": "14"}}, wantErr: true},
+		{name: "operator attribute name", item: db.StoreItem{Attributes: map[string]interface{}{"$set": "a"}}, wantErr: true},
+		{name: "dollar inside attribute name", item: db.StoreItem{Attributes: map[string]interface{}{"price_$": "a"}}},
+		{name: "longest attribute value", item: db.StoreItem{Attributes: map[string]interface{}{"a": strings.Repeat("a", maxAttributeValueLength)}}},
+		{name: "long attribute value", item: db.StoreItem{Attributes: map[string]interface{}{"a": strings.Repeat("a", maxAttributeValueLength+1)}}, wantErr: true},
+		{name: "object attribute", item: db.StoreItem{Attributes: map[string]interface{}{"a": map[string]interface{}{}}}, wantErr: true},
+		{name: "array attribute", item: db.StoreItem{Attributes: map[string]interface{}{"a": []interface{}{"b"}}}, wantErr: true},
+		{name: "null attribute", item: db.StoreItem{Attributes: map[string]interface{}{"a": nil}}, wantErr: true},
+		{name: "too many images", item: db.StoreItem{Images: manyImages}, wantErr: true},
+		{name: "relative image", item: db.StoreItem{Images: []string{"/laptop.png"}}, wantErr: true},
+		{name: "image of another scheme", item: db.StoreItem{Images: []string{"ftp://example.com/laptop.png"}}, wantErr: true},
+		{name: "image without host", item: db.StoreItem{Images: []string{"https:///laptop.png"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateItem(&tt.item)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Got error %v, want error: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,10 +1,16 @@
 package utils
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 type ClientResponse struct {
@@ -31,3 +37,50 @@ func SendError(w http.ResponseWriter, code int, formatMsg string, args ...interf
 	log.Printf(msg)
 	SendBodyResponse(w, msg, code)
 }
+
+func SendJSON(w http.ResponseWriter, v interface{}, code int) {
+	encodedJson, err := json.Marshal(v)
+	if err != nil {
+		SendError(w, http.StatusInternalServerError, "Can't encode JSON response, got an error: %s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "%s\n", string(encodedJson))
+}
+
+// ReadJSON decodes request body into v, on failure error response is already written
+func ReadJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	contents, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		SendError(w, http.StatusBadRequest, "Can't parse request body, got error: %s", err.Error())
+		return false
+	}
+	err = json.Unmarshal(contents, v)
+	if err != nil {
+		SendError(w, http.StatusBadRequest, "Can't unrmashal contents, expected valid JSON: %s", err.Error())
+		return false
+	}
+	return true
+}
+
+// ListenAndServe serves until SIGINT or SIGTERM, then waits for active requests
+// to complete for at most shutdownTimeout
+func ListenAndServe(addr string, handler http.Handler, shutdownTimeout time.Duration) error {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		log.Printf("Got %s, shutting down\n", sig)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}